@@ -0,0 +1,164 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AcceptItem is a single media range of an Accept header.
+type AcceptItem struct {
+	// MediaType is the lower cased media range, e.g. "text/html", "text/*"
+	// or "*/*".
+	MediaType string
+	// Params holds the media range parameters, excluding the quality.
+	Params map[string]string
+	// Q is the quality value, 1 when not given.
+	Q float64
+}
+
+// specificity ranks how specific the media range is: */* < type/* < type/subtype,
+// with parameters making a range more specific still.
+func (i AcceptItem) specificity() int {
+	switch {
+	case i.MediaType == "*/*":
+		return 0
+	case strings.HasSuffix(i.MediaType, "/*"):
+		return 1
+	}
+	return 2 + len(i.Params)
+}
+
+// matches reports whether the media range matches mediaType.
+func (i AcceptItem) matches(mediaType string) bool {
+	if i.MediaType == "*/*" || i.MediaType == mediaType {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(i.MediaType, "*"); ok {
+		return strings.HasPrefix(mediaType, prefix)
+	}
+	return false
+}
+
+// ParseAccept parses an Accept header value into its media ranges, sorted
+// by descending quality. Ranges of equal quality are ordered from the most
+// to the least specific, as RFC 7231 gives precedence to the more specific
+// range. Malformed ranges are skipped.
+func ParseAccept(header string) []AcceptItem {
+	var items []AcceptItem
+	for _, v := range parseQualityList(header) {
+		if !strings.Contains(v.value, "/") {
+			continue
+		}
+		items = append(items, AcceptItem{
+			MediaType: v.value,
+			Params:    v.params,
+			Q:         v.q,
+		})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Q != items[j].Q {
+			return items[i].Q > items[j].Q
+		}
+		return items[i].specificity() > items[j].specificity()
+	})
+	return items
+}
+
+// Negotiate returns the offer best matching the accept header value, or ""
+// when none of the offers is acceptable. Each offer takes the quality of the
+// most specific media range matching it; among offers of equal quality the
+// one listed first wins. An empty accept header accepts the first offer.
+func Negotiate(accept string, offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	items := ParseAccept(accept)
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, offer := range offers {
+		mediaType, _, _ := strings.Cut(offer, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+		q, specificity := 0.0, -1
+		for _, item := range items {
+			if s := item.specificity(); item.matches(mediaType) && s > specificity {
+				q, specificity = item.Q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+type qualityItem struct {
+	value  string
+	params map[string]string
+	q      float64
+}
+
+// parseQualityList parses a comma separated header value whose elements may
+// carry a q parameter, such as Accept or Accept-Encoding. Values are lower
+// cased. Elements with an invalid quality are skipped.
+func parseQualityList(header string) []qualityItem {
+	var items []qualityItem
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(fields[0]))
+		if value == "" {
+			continue
+		}
+
+		item := qualityItem{value: value, q: 1}
+		valid := true
+		for _, p := range fields[1:] {
+			k, v, _ := strings.Cut(p, "=")
+			k = strings.ToLower(strings.TrimSpace(k))
+			v = strings.Trim(strings.TrimSpace(v), `"`)
+			if k == "" {
+				continue
+			}
+			if k == "q" {
+				q, err := strconv.ParseFloat(v, 64)
+				if err != nil || q < 0 || q > 1 {
+					valid = false
+					break
+				}
+				item.q = q
+				continue
+			}
+			if item.params == nil {
+				item.params = make(map[string]string)
+			}
+			item.params[k] = v
+		}
+		if valid {
+			items = append(items, item)
+		}
+	}
+	return items
+}
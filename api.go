@@ -1,15 +1,24 @@
 package transport
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha1"
 	"encoding/gob"
 	"encoding/json"
+	"encoding/xml"
+	errorsv2 "errors"
 	"fmt"
 	"github.com/deepauto-io/errors"
 	"github.com/deepauto-io/log"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // PlatformErrorCodeHeader shows the error code of platform error.
@@ -23,8 +32,41 @@ type API struct {
 
 	prettyJSON bool
 	encodeGZIP bool
+	envelope   bool
+	etag       bool
 
+	gzipContentLength bool
+	gzipLevel         int
+	gzipPredicate     func(r *http.Request, status int, contentType string, size int) bool
+
+	compression       []string
+	compressMinSize   int
+	compressMinSaving float64
+	compressors       map[string]CompressorFunc
+
+	retryAfter  map[string]time.Duration
+	statusCodes map[string]int
+
+	jsonKeyResolver func(key string) string
+	strictJSON      bool
+	singleJSONValue bool
+
+	maxBodyBytes   int64
+	allowEmptyBody bool
+
+	encoders map[string]EncoderFunc
+	offers   []string
+
+	decoders          map[string]DecoderFunc
+	decoderMediaTypes map[string]string
+
+	decodeMetrics func(encoding string, err error)
+	encodeMetrics func(mediaType string, err error)
+
+	problemJSON    bool
+	problemTypeFn  func(code string) string
 	unmarshalErrFn func(encoding string, err error) error
+	marshalErrFn   func(err error) error
 	okErrFn        func(err error) error
 	errFn          func(ctx context.Context, err error) (interface{}, int, error)
 }
@@ -60,6 +102,34 @@ func WithPrettyJSON(b bool) APIOptFn {
 	}
 }
 
+type prettyKey struct{}
+
+// WithPretty returns a copy of ctx that forces responses to be pretty
+// printed, or compact, regardless of WithPrettyJSON. It lets e.g. a debug
+// middleware enable pretty output for flagged requests only.
+func WithPretty(ctx context.Context, pretty bool) context.Context {
+	return context.WithValue(ctx, prettyKey{}, pretty)
+}
+
+// WithEnvelope nests every response body in an Envelope: Respond puts the
+// payload under "data" and Err puts the error under "error", with "success"
+// telling them apart. Status codes are mapped exactly as without it.
+func WithEnvelope() APIOptFn {
+	return func(api *API) {
+		api.envelope = true
+	}
+}
+
+// WithETag makes Respond set an ETag, the hash of the encoded body, on 200
+// responses to GET and HEAD requests, and answer requests whose
+// If-None-Match matches it with 304 Not Modified, without a body. The
+// response is still encoded, so this saves bandwidth rather than work.
+func WithETag() APIOptFn {
+	return func(api *API) {
+		api.etag = true
+	}
+}
+
 // WithEncodeGZIP sets the encoder to gzip contents.
 func WithEncodeGZIP() APIOptFn {
 	return func(api *API) {
@@ -67,6 +137,42 @@ func WithEncodeGZIP() APIOptFn {
 	}
 }
 
+// WithGZIPLevel sets the level gzip compresses responses with, from
+// gzip.BestSpeed to gzip.BestCompression, or gzip.HuffmanOnly. Faster levels
+// save CPU on busy services at the cost of larger responses, higher levels
+// produce smaller responses for more CPU, which suits rarely changing,
+// often downloaded content. The level applies to deflate as well. Invalid
+// levels fall back to gzip.DefaultCompression.
+func WithGZIPLevel(level int) APIOptFn {
+	return func(api *API) {
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			level = gzip.DefaultCompression
+		}
+		api.gzipLevel = level
+	}
+}
+
+// WithGZIPContentLength makes a gzip enabled API compress the body into a
+// buffer before writing it, so the response carries a Content-Length instead
+// of being sent chunked. This trades memory for compatibility with clients
+// and proxies that cannot handle chunked compressed responses.
+func WithGZIPContentLength() APIOptFn {
+	return func(api *API) {
+		api.gzipContentLength = true
+	}
+}
+
+// WithGZIPPredicate sets the function deciding, per response, whether a
+// gzip enabled API (see WithEncodeGZIP) compresses the body. It receives the
+// request, the status code, the response Content-Type and the size of the
+// uncompressed body; the request is nil for responses written with Write.
+// Without a predicate every response is compressed.
+func WithGZIPPredicate(fn func(r *http.Request, status int, contentType string, size int) bool) APIOptFn {
+	return func(api *API) {
+		api.gzipPredicate = fn
+	}
+}
+
 // WithUnmarshalErrFn sets the error handler for errors that occur when unmarshalling
 // the request body.
 func WithUnmarshalErrFn(fn func(encoding string, err error) error) APIOptFn {
@@ -75,46 +181,277 @@ func WithUnmarshalErrFn(fn func(encoding string, err error) error) APIOptFn {
 	}
 }
 
+// WithMarshalErrFn sets the function shaping errors that occur when
+// encoding a response body, before they are written with Err. The default
+// replaces them with a generic errors.EInternal error, so Go type details of
+// an unserializable value never reach the client; the original error is
+// logged either way.
+func WithMarshalErrFn(fn func(err error) error) APIOptFn {
+	return func(api *API) {
+		api.marshalErrFn = fn
+	}
+}
+
+// WithRetryAfterDefaults sets the Retry-After duration written for errors of
+// the given codes, e.g. errors.EUnavailable or errors.ETooManyRequests, when
+// the error carries no hint of its own (see WithRetryAfter).
+func WithRetryAfterDefaults(defaults map[string]time.Duration) APIOptFn {
+	return func(api *API) {
+		api.retryAfter = defaults
+	}
+}
+
+// WithStatusCodeMapping overrides the status codes of the given error codes
+// for this API, e.g. {errors.EConflict: http.StatusConflict}. Error codes
+// without an override keep the package mapping, see ErrorCodeToStatusCode.
+// Custom error functions set with WithErrFn honor the overrides by calling
+// the API's ErrorCodeToStatusCode method.
+func WithStatusCodeMapping(mapping map[string]int) APIOptFn {
+	return func(api *API) {
+		api.statusCodes = mapping
+	}
+}
+
+// ErrorCodeToStatusCode is like the package function ErrorCodeToStatusCode
+// but consults the overrides set with WithStatusCodeMapping first. Client
+// disconnects and timeouts are still answered with 499 and 408.
+func (a *API) ErrorCodeToStatusCode(ctx context.Context, code string) int {
+	if a != nil && ctx.Err() == nil {
+		if status, ok := a.statusCodes[code]; ok {
+			return status
+		}
+	}
+	return ErrorCodeToStatusCode(ctx, code)
+}
+
+// WithMaxBodyBytes limits the number of bytes read from a request body by
+// the Decode methods. Bodies exceeding the limit fail to decode with an
+// errors.ETooLarge error. Zero, the default, means unlimited, except for
+// gzip compressed bodies, which are limited to 10 MiB decompressed.
+func WithMaxBodyBytes(n int64) APIOptFn {
+	return func(api *API) {
+		api.maxBodyBytes = n
+	}
+}
+
+// WithAllowEmptyBody makes the Decode methods treat an empty request body
+// as the zero value, which is then validated as usual, instead of failing
+// with an errors.EInvalid "request body is required" error. Use it for APIs
+// whose endpoints accept an optional body.
+func WithAllowEmptyBody() APIOptFn {
+	return func(api *API) {
+		api.allowEmptyBody = true
+	}
+}
+
+// WithDecodeMetrics sets a hook called with the encoding and the error of
+// every request body that fails to decode, before the error is mapped by
+// WithUnmarshalErrFn, e.g. to count malformed requests by encoding and
+// error type.
+func WithDecodeMetrics(fn func(encoding string, err error)) APIOptFn {
+	return func(api *API) {
+		api.decodeMetrics = fn
+	}
+}
+
+// WithEncodeMetrics sets a hook called with the media type and the error of
+// every response Respond fails to encode.
+func WithEncodeMetrics(fn func(mediaType string, err error)) APIOptFn {
+	return func(api *API) {
+		api.encodeMetrics = fn
+	}
+}
+
+// WithJSONKeyResolver sets a function that renames every object key of a
+// JSON request body before it is matched against struct fields, e.g.
+// strings.ToLower, to ingest payloads with inconsistently cased keys without
+// annotating each field with several tags. Keys of an object that resolve
+// to the same name are rejected with an errors.EInvalid error. Validation
+// still runs afterwards.
+func WithJSONKeyResolver(fn func(key string) string) APIOptFn {
+	return func(api *API) {
+		api.jsonKeyResolver = fn
+	}
+}
+
+// WithStrictJSON makes DecodeJSON reject request bodies with object keys
+// that match no field of the destination, to catch client bugs early. The
+// error goes through the unmarshal error function like any other decoding
+// error. By default unknown keys are ignored.
+func WithStrictJSON() APIOptFn {
+	return func(api *API) {
+		api.strictJSON = true
+	}
+}
+
+// WithSingleJSONValue makes DecodeJSON reject request bodies with data after
+// the first JSON value, e.g. {"a":1}{"b":2}, with an errors.EInvalid error
+// instead of silently ignoring the rest. It is opt-in since streaming
+// clients may rely on the lenient default.
+func WithSingleJSONValue() APIOptFn {
+	return func(api *API) {
+		api.singleJSONValue = true
+	}
+}
+
 // NewAPI creates a new API type.
 func NewAPI(opts ...APIOptFn) *API {
-	api := API{
+	api := &API{}
+	*api = API{
 		prettyJSON: true,
+		gzipLevel:  gzip.DefaultCompression,
 		unmarshalErrFn: func(encoding string, err error) error {
 			return &errors.Error{
 				Code: errors.EInvalid,
 				Msg:  fmt.Sprintf("failed to unmarshal %s: %s", encoding, err),
 			}
 		},
+		marshalErrFn: func(err error) error {
+			return &errors.Error{
+				Code: errors.EInternal,
+				Msg:  "failed to encode response",
+			}
+		},
 		errFn: func(ctx context.Context, err error) (interface{}, int, error) {
-			msg := err.Error()
+			msg := errorMessage(err)
 			if msg == "" {
 				msg = "an internal error has occurred"
 			}
-			code := errors.ErrorCode(err)
+			code := errorCode(err)
 			return ErrBody{
-				Code: code,
-				Msg:  msg,
-			}, ErrorCodeToStatusCode(ctx, code), nil
+				Code:    code,
+				Msg:     msg,
+				Details: errorDetails(err),
+			}, api.ErrorCodeToStatusCode(ctx, code), nil
 		},
 	}
 	for _, o := range opts {
-		o(&api)
+		o(api)
 	}
-	return &api
+	return api
 }
 
 // DecodeJSON decodes reader with json.
 func (a *API) DecodeJSON(r io.Reader, v interface{}) error {
-	return a.decode("json", json.NewDecoder(r), v)
+	return a.decode("json", a.jsonDecoder(a.limitBody(r)), v)
 }
 
 // DecodeGob decodes reader with gob.
 func (a *API) DecodeGob(r io.Reader, v interface{}) error {
-	return a.decode("gob", gob.NewDecoder(r), v)
+	return a.decode("gob", gob.NewDecoder(a.limitBody(r)), v)
+}
+
+// DecodeXML decodes reader with xml.
+func (a *API) DecodeXML(r io.Reader, v interface{}) error {
+	return a.decode("xml", xml.NewDecoder(a.limitBody(r)), v)
+}
+
+// DecodeMsgpack decodes reader with msgpack, using the decoder registered
+// for the "msgpack" encoding with WithDecoder, e.g.
+//
+//	transport.WithDecoder(transport.MsgpackMediaType, "msgpack", func(r io.Reader) transport.Decoder {
+//		return msgpack.NewDecoder(r)
+//	})
+//
+// so the core does not depend on a msgpack package.
+func (a *API) DecodeMsgpack(r io.Reader, v interface{}) error {
+	newDecoder, ok := a.newDecoder("msgpack")
+	if !ok {
+		return &errors.Error{
+			Code: errors.ENotImplemented,
+			Msg:  "no msgpack decoder registered",
+		}
+	}
+	return a.decode("msgpack", newDecoder(a.limitBody(r)), v)
+}
+
+// DecodeRequest decodes the body of r, picking the decoder from its
+// Content-Type: XML for application/xml and text/xml, gob for
+// application/x-gob, a form for application/x-www-form-urlencoded (see
+// DecodeForm), the decoders registered with WithDecoder for their media
+// types and JSON otherwise. Bodies with a gzip Content-Encoding
+// are decompressed first, see DecompressRequest, and limited to 10 MiB
+// decompressed unless WithMaxBodyBytes sets another limit.
+func (a *API) DecodeRequest(r *http.Request, v interface{}) error {
+	body, err := a.requestBody(r)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	encoding, ok := a.requestEncoding(r)
+	if !ok {
+		encoding = "json"
+	}
+	newDecoder, _ := a.newDecoder(encoding)
+	return a.decode(encoding, newDecoder(a.limitBody(body)), v)
+}
+
+// DecodeAny decodes the body of r with the first of encodings, such as
+// "json" or "xml", matching its Content-Type. Legacy clients send missing or
+// inconsistent content types, so when none matches, the body is buffered
+// and decoded with each of encodings in turn until one succeeds. If all of
+// them fail, the error of the first one is returned, even if a later one got
+// further: encodings are listed in order of preference, so the first is the
+// format the client most likely meant to send. Failing to read the body is
+// an errors.EInvalid error, or errors.ETooLarge past the body limit.
+func (a *API) DecodeAny(r *http.Request, v interface{}, encodings ...string) error {
+	body, err := a.requestBody(r)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if encoding, ok := a.requestEncoding(r); ok {
+		for _, e := range encodings {
+			if e == encoding {
+				newDecoder, _ := a.newDecoder(encoding)
+				return a.decode(encoding, newDecoder(a.limitBody(body)), v)
+			}
+		}
+	}
+
+	b, err := io.ReadAll(a.limitBody(body))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errorsv2.As(err, &maxErr) || isPlatformError(err) {
+			return a.unmarshalErr("body", err)
+		}
+		return &errors.Error{
+			Code: errors.EInvalid,
+			Msg:  "failed to read request body",
+			Err:  err,
+		}
+	}
+	var firstErr error
+	for _, encoding := range encodings {
+		newDecoder, ok := a.newDecoder(encoding)
+		if !ok {
+			continue
+		}
+		resetValue(v)
+		if err := a.decodeValue(newDecoder(bytes.NewReader(b)), v); err != nil {
+			if firstErr == nil {
+				firstErr = a.unmarshalErr(encoding, err)
+			}
+			continue
+		}
+		// the body is in this encoding, a validation failure is final.
+		return a.validate(v)
+	}
+	if firstErr == nil {
+		return &errors.Error{
+			Code: errors.EInternal,
+			Msg:  fmt.Sprintf("no decoder for any of the encodings %q", encodings),
+		}
+	}
+	return firstErr
 }
 
 type (
-	decoder interface {
+	// Decoder decodes a value from its input, like *json.Decoder. Decoders
+	// of third party formats, such as msgpack, usually satisfy it as is.
+	Decoder interface {
 		Decode(interface{}) error
 	}
 
@@ -123,16 +460,62 @@ type (
 	}
 )
 
-func (a *API) decode(encoding string, dec decoder, v interface{}) error {
-	if err := dec.Decode(v); err != nil {
-		if a != nil && a.unmarshalErrFn != nil {
-			return a.unmarshalErrFn(encoding, err)
+func (a *API) decode(encoding string, dec Decoder, v interface{}) error {
+	if err := a.decodeValue(dec, v); err != nil {
+		return a.unmarshalErr(encoding, err)
+	}
+	return a.validate(v)
+}
+
+// decodeValue decodes v with dec, without validating it, applying the
+// empty body and single JSON value rules. Its errors are not yet passed
+// through unmarshalErr.
+func (a *API) decodeValue(dec Decoder, v interface{}) error {
+	if err := dec.Decode(v); err == io.EOF {
+		// io.EOF, as opposed to io.ErrUnexpectedEOF, means the body is empty.
+		if a == nil || !a.allowEmptyBody {
+			return &errors.Error{
+				Code: errors.EInvalid,
+				Msg:  "request body is required",
+			}
 		}
+	} else if err != nil {
 		return err
+	} else if a != nil && a.singleJSONValue {
+		return trailingJSON(dec)
 	}
+	return nil
+}
 
+func (a *API) unmarshalErr(encoding string, err error) error {
+	if a != nil && a.decodeMetrics != nil {
+		a.decodeMetrics(encoding, err)
+	}
+	var maxErr *http.MaxBytesError
+	if errorsv2.As(err, &maxErr) {
+		return &errors.Error{
+			Code: errors.ETooLarge,
+			Msg:  fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit),
+			Err:  err,
+		}
+	}
+	if isPlatformError(err) {
+		// failures reading the body, e.g. RejectSlowBodies, already carry
+		// a meaningful code.
+		return err
+	}
+	if a != nil && a.unmarshalErrFn != nil {
+		return a.unmarshalErrFn(encoding, err)
+	}
+	return err
+}
+
+func (a *API) validate(v interface{}) error {
 	if vv, ok := v.(oker); ok {
 		err := vv.OK()
+		if err != nil {
+			err = fieldValidationError(err)
+		}
 		if a != nil && a.okErrFn != nil {
 			return a.okErrFn(err)
 		}
@@ -143,24 +526,43 @@ func (a *API) decode(encoding string, dec decoder, v interface{}) error {
 }
 
 // Respond writes to the response writer, handling all errors in writing.
+// A json.RawMessage, or a []byte when the Content-Type header is set to
+// application/json, is written as is rather than marshaled again, e.g. to
+// serve cached JSON; it is still validated, compressed and enveloped. The
+// format is negotiated from the request's Accept header, see WithEncoder.
 func (a *API) Respond(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if a != nil && a.envelope {
+		v = Envelope{Success: true, Data: v}
+	}
+	a.respond(w, r, status, v)
+}
+
+func (a *API) respond(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	setContextHeaders(w.Header(), r.Context())
+
 	if status == http.StatusNoContent {
 		w.WriteHeader(status)
 		return
 	}
 
-	var writer io.WriteCloser = noopCloser{Writer: w}
-	// we'll double close to make sure its always closed even
-	//on issues before to write
-	defer writer.Close()
-
-	if a != nil && a.encodeGZIP {
-		w.Header().Set("Content-Encoding", "gzip")
-		writer = gzip.NewWriter(w)
+	mediaType := a.negotiate(w, r)
+	if mediaType == "" {
+		var body interface{} = ErrBody{
+			Code: ENotAcceptable,
+			Msg:  fmt.Sprintf("unsupported accept header: %q", r.Header.Get("Accept")),
+		}
+		if a.envelope {
+			body = Envelope{Error: body}
+		}
+		w.Header().Set(PlatformErrorCodeHeader, ENotAcceptable)
+		a.encodeAndWrite(w, r, http.StatusNotAcceptable, jsonMediaType, body)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	a.encodeAndWrite(w, r, status, mediaType, v)
+}
 
+func (a *API) encodeAndWrite(w http.ResponseWriter, r *http.Request, status int, mediaType string, v interface{}) {
 	// this marshal block is to catch failures before they hit the http writer.
 	// default behavior for http.ResponseWriter is when body is written and no
 	// status is set, it writes a 200. Or if a status is set before encoding
@@ -169,20 +571,158 @@ func (a *API) Respond(w http.ResponseWriter, r *http.Request, status int, v inte
 	// and then writes the data and sets the status code after marshaling
 	// succeeds.
 	var (
-		b   []byte
-		err error
+		b           []byte
+		err         error
+		contentType = mediaType
 	)
-	if a == nil || a.prettyJSON {
-		b, err = json.MarshalIndent(v, "", "\t")
+	if fn, ok := a.encoder(mediaType); ok {
+		var buf bytes.Buffer
+		err = fn(&buf, v)
+		b = buf.Bytes()
+	} else if raw, ok := rawJSON(w, v); ok {
+		b, err = raw, validJSON(raw)
+		contentType = "application/json; charset=utf-8"
 	} else {
-		b, err = json.Marshal(v)
+		b, err = a.marshal(v, a.pretty(r.Context()))
+		contentType = "application/json; charset=utf-8"
 	}
 	if err != nil {
-		a.Err(w, r, err)
+		if a != nil && a.encodeMetrics != nil {
+			a.encodeMetrics(mediaType, err)
+		}
+		a.Err(w, r, a.marshalErr(err))
+		return
+	}
+
+	if a != nil && a.etag && status == http.StatusOK &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		sum := sha1.Sum(b)
+		etag := formatETag(sum[:])
+		w.Header().Set("ETag", etag)
+		if etagMatch(r.Header.Get("If-None-Match"), etag, false) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	a.write(w, r, status, b)
+}
+
+// marshalErr logs err, a failure to encode a response, and shapes it for the
+// client.
+func (a *API) marshalErr(err error) error {
+	if a == nil {
+		return err
+	}
+	if a.logger != nil {
+		a.logger.
+			WithField("api", "respond").
+			Error("failed to encode response: ", err)
+	}
+	if a.marshalErrFn != nil {
+		return a.marshalErrFn(err)
+	}
+	return err
+}
+
+// encoder returns the encoder registered for mediaType.
+func (a *API) encoder(mediaType string) (EncoderFunc, bool) {
+	if a != nil {
+		if fn, ok := a.encoders[mediaType]; ok {
+			return fn, true
+		}
+	}
+	switch mediaType {
+	case xmlMediaType:
+		return XMLEncoder, true
+	case gobMediaType:
+		return GobEncoder, true
+	}
+	return nil, false
+}
+
+// Encode writes v to w with the API's JSON settings, compressing it with
+// gzip when the API is configured to. It lets the response encoding be
+// reused outside of an HTTP handler, e.g. to render cached fixtures.
+func (a *API) Encode(w io.Writer, v interface{}) error {
+	b, err := a.marshal(v, a == nil || a.prettyJSON)
+	if err != nil {
+		return err
+	}
+
+	var wc io.WriteCloser = noopCloser{Writer: w}
+	if a != nil && a.encodeGZIP {
+		wc = a.newGZIPWriter(w)
+	}
+	if _, err := wc.Write(b); err != nil {
+		return err
+	}
+	return wc.Close()
+}
+
+// pretty reports whether responses to the request with ctx are pretty
+// printed, honoring a WithPretty override.
+func (a *API) pretty(ctx context.Context) bool {
+	if pretty, ok := ctx.Value(prettyKey{}).(bool); ok {
+		return pretty
+	}
+	return a == nil || a.prettyJSON
+}
+
+// rawJSON returns v when it is already marshaled JSON: a json.RawMessage,
+// or a []byte when the response Content-Type is set to JSON. Other []byte
+// values are encoded as base64 strings, as by encoding/json.
+func rawJSON(w http.ResponseWriter, v interface{}) ([]byte, bool) {
+	switch vv := v.(type) {
+	case json.RawMessage:
+		return vv, true
+	case []byte:
+		mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		return vv, mediaType == jsonMediaType
+	}
+	return nil, false
+}
+
+// validJSON returns an error when b is not valid JSON, so a corrupt cached
+// payload is answered like any response that fails to encode.
+func validJSON(b []byte) error {
+	if !json.Valid(b) {
+		return errorsv2.New("invalid raw JSON response")
+	}
+	return nil
+}
+
+func (a *API) marshal(v interface{}, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(v, "", "\t")
+	}
+	return json.Marshal(v)
+}
+
+// RespondXML is like Respond but always writes v as XML, regardless of the
+// request's Accept header.
+func (a *API) RespondXML(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if a != nil && a.envelope {
+		v = Envelope{Success: true, Data: v}
+	}
+
+	setContextHeaders(w.Header(), r.Context())
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
 		return
 	}
+	a.encodeAndWrite(w, r, status, xmlMediaType, v)
+}
 
-	a.write(w, writer, status, b)
+// RespondWithCookies sets each of cookies on the response before calling
+// Respond, guaranteeing they are part of the header rather than silently
+// dropped because the status was already written.
+func (a *API) RespondWithCookies(w http.ResponseWriter, r *http.Request, status int, v interface{}, cookies []*http.Cookie) {
+	for _, c := range cookies {
+		http.SetCookie(w, c)
+	}
+	a.Respond(w, r, status, v)
 }
 
 // Write allows the user to write raw bytes to the response writer. This
@@ -193,44 +733,120 @@ func (a *API) Write(w http.ResponseWriter, status int, b []byte) {
 		return
 	}
 
-	var writer io.WriteCloser = noopCloser{Writer: w}
-	// we'll double close to make sure its always closed even
-	//on issues before to write
-	defer writer.Close()
+	a.write(w, nil, status, b)
+}
 
-	if a != nil && a.encodeGZIP {
-		w.Header().Set("Content-Encoding", "gzip")
-		writer = gzip.NewWriter(w)
+// write writes b with the given status, compressing it when the API is
+// configured to. r is nil when there is no request to consult.
+func (a *API) write(w http.ResponseWriter, r *http.Request, status int, b []byte) {
+	// answer HEAD requests with the headers of the GET response, including
+	// its Content-Length, but without the body.
+	head := r != nil && r.Method == http.MethodHead
+
+	var wc io.WriteCloser = noopCloser{Writer: w}
+	if coding := a.contentCoding(w, r, status, w.Header().Get("Content-Type"), len(b)); coding != "" {
+		if head || a.gzipContentLength || a.compressMinSaving > 0 {
+			a.writeCompressedBuffered(w, status, coding, b, head)
+			return
+		}
+		w.Header().Set("Content-Encoding", coding)
+		wc = a.compressor(coding)(w)
 	}
 
-	a.write(w, writer, status, b)
-}
+	if head {
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.WriteHeader(status)
+		return
+	}
 
-func (a *API) write(w http.ResponseWriter, wc io.WriteCloser, status int, b []byte) {
 	w.WriteHeader(status)
 	if _, err := wc.Write(b); err != nil {
-		a.logger.
-			WithField("api", "write").
-			Error("failed to write to response writer: ", err)
+		a.logWriteError("write", "failed to write to response writer: ", err)
 	}
 
 	if err := wc.Close(); err != nil {
+		a.logWriteError("write", "failed to close response writer", err)
+	}
+}
+
+// writeCompressedBuffered compresses b up front so the Content-Length of the
+// compressed body is known before the header is written, and so b can be
+// written uncompressed when compressing does not save enough. With head
+// only the header is written.
+func (a *API) writeCompressedBuffered(w http.ResponseWriter, status int, coding string, b []byte, head bool) {
+	var buf bytes.Buffer
+	cw := a.compressor(coding)(&buf)
+	_, err := cw.Write(b)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
 		a.logger.
 			WithField("api", "write").
-			Error("failed to close response writer", err)
+			Error("failed to compress response, writing it uncompressed: ", err)
+		buf.Reset()
+		buf.Write(b)
+	} else if a.compressMinSaving > 0 && float64(buf.Len()) > float64(len(b))*(1-a.compressMinSaving) {
+		buf.Reset()
+		buf.Write(b)
+	} else {
+		w.Header().Set("Content-Encoding", coding)
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	if head {
+		return
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		a.logWriteError("write", "failed to write to response writer: ", err)
 	}
 }
 
+// logWriteError logs an error writing a response. Errors caused by the
+// client going away, e.g. after navigating elsewhere, are no server fault
+// and are logged at Debug level only.
+func (a *API) logWriteError(api, msg string, err error) {
+	logger := a.logger.WithField("api", api)
+	if isClientGone(err) {
+		logger.Debug(msg, err)
+		return
+	}
+	logger.Error(msg, err)
+}
+
+// isClientGone reports whether err stems from the client closing the
+// connection.
+func isClientGone(err error) bool {
+	return errorsv2.Is(err, syscall.EPIPE) ||
+		errorsv2.Is(err, syscall.ECONNRESET) ||
+		errorsv2.Is(err, context.Canceled)
+}
+
+func (a *API) shouldGZIP(r *http.Request, status int, contentType string, size int) bool {
+	if a == nil || !a.encodeGZIP {
+		return false
+	}
+	if a.gzipPredicate != nil {
+		return a.gzipPredicate(r, status, contentType, size)
+	}
+	return true
+}
+
 // Err is used for writing an error to the response.
 func (a *API) Err(w http.ResponseWriter, r *http.Request, err error) {
 	if err == nil {
 		return
 	}
+	if a != nil && a.problemJSON {
+		a.respondProblem(w, r, err)
+		return
+	}
 
-	v, status, err := a.errFn(r.Context(), err)
-	if err != nil {
-		a.logger.Error("failed to write err to response writer", err)
-		a.Respond(w, r, http.StatusInternalServerError, ErrBody{
+	v, status, fnErr := a.errFn(r.Context(), err)
+	if fnErr != nil {
+		a.logger.Error("failed to write err to response writer", fnErr)
+		a.respondErr(w, r, http.StatusInternalServerError, ErrBody{
 			Code: "internal error",
 			Msg:  "an unexpected error occurred",
 		})
@@ -239,8 +855,77 @@ func (a *API) Err(w http.ResponseWriter, r *http.Request, err error) {
 
 	if eb, ok := v.(ErrBody); ok {
 		w.Header().Set(PlatformErrorCodeHeader, eb.Code)
+		SetErrorCode(r.Context(), eb.Code)
+		if id, ok := RequestIDFromContext(r.Context()); ok && eb.RequestID == "" {
+			eb.RequestID = id
+			v = eb
+		}
 	}
-	a.Respond(w, r, status, v)
+	setRetryAfter(w.Header(), err, a.retryAfter)
+	a.respondErr(w, r, status, v)
+}
+
+// respondErr writes the error body v, nesting it in the envelope the API or
+// the request asks for.
+func (a *API) respondErr(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if a != nil && a.envelope {
+		v = Envelope{Error: v}
+	}
+	if errorsAsData(r.Context()) {
+		if a == nil || !a.envelope {
+			v = DataError{Error: v}
+		}
+		status = http.StatusOK
+	}
+	a.respond(w, r, status, v)
+}
+
+// gzipWriters pools gzip writers, which are expensive to allocate, across
+// responses, with a pool per compression level from gzip.HuffmanOnly to
+// gzip.BestCompression.
+var gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+func init() {
+	for i := range gzipWriters {
+		level := i + gzip.HuffmanOnly
+		gzipWriters[i].New = func() interface{} {
+			zw, _ := gzip.NewWriterLevel(io.Discard, level)
+			return zw
+		}
+	}
+}
+
+// newGZIPWriterLevel returns a pooled gzip writer compressing to w with the
+// given level, which must be valid. It is returned to the pool when closed,
+// so it must not be used afterwards.
+func newGZIPWriterLevel(w io.Writer, level int) io.WriteCloser {
+	pool := &gzipWriters[level-gzip.HuffmanOnly]
+	zw := pool.Get().(*gzip.Writer)
+	zw.Reset(w)
+	return &pooledGZIPWriter{Writer: zw, pool: pool}
+}
+
+// newGZIPWriter returns a pooled gzip writer compressing to w with the
+// level set with WithGZIPLevel.
+func (a *API) newGZIPWriter(w io.Writer) io.WriteCloser {
+	return newGZIPWriterLevel(w, a.gzipLevel)
+}
+
+type pooledGZIPWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (p *pooledGZIPWriter) Close() error {
+	if p.Writer == nil {
+		return nil
+	}
+	err := p.Writer.Close()
+	// drop the reference to the response writer before pooling.
+	p.Writer.Reset(io.Discard)
+	p.pool.Put(p.Writer)
+	p.Writer = nil
+	return err
 }
 
 type noopCloser struct {
@@ -253,6 +938,11 @@ func (n noopCloser) Close() error {
 
 // ErrBody is an err response body.
 type ErrBody struct {
-	Code string `json:"code"`
-	Msg  string `json:"message"`
+	XMLName xml.Name    `json:"-" xml:"error"`
+	Code    string      `json:"code" xml:"code"`
+	Msg     string      `json:"message" xml:"message"`
+	Details interface{} `json:"details,omitempty" xml:"details,omitempty"`
+	// RequestID is the ID of the failed request (see RequestID), for users
+	// to quote when reporting the error.
+	RequestID string `json:"request_id,omitempty" xml:"request_id,omitempty"`
 }
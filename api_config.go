@@ -0,0 +1,96 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"sort"
+	"time"
+)
+
+// APIConfig is a snapshot of the effective settings of an API, suitable for
+// logging at startup or exposing on a debug endpoint. Changing it has no
+// effect on the API it was taken from.
+type APIConfig struct {
+	PrettyJSON         bool                     `json:"pretty_json"`
+	EncodeGZIP         bool                     `json:"encode_gzip"`
+	Envelope           bool                     `json:"envelope"`
+	ETag               bool                     `json:"etag"`
+	GZIPContentLength  bool                     `json:"gzip_content_length"`
+	GZIPLevel          int                      `json:"gzip_level"`
+	GZIPPredicate      bool                     `json:"gzip_predicate"`
+	JSONKeyResolver    bool                     `json:"json_key_resolver"`
+	StrictJSON         bool                     `json:"strict_json"`
+	SingleJSONValue    bool                     `json:"single_json_value"`
+	Compression        []string                 `json:"compression,omitempty"`
+	CompressMinSize    int                      `json:"compress_min_size,omitempty"`
+	CompressMinSaving  float64                  `json:"compress_min_saving,omitempty"`
+	MaxBodyBytes       int64                    `json:"max_body_bytes,omitempty"`
+	AllowEmptyBody     bool                     `json:"allow_empty_body"`
+	ProblemJSON        bool                     `json:"problem_json"`
+	Encoders           []string                 `json:"encoders,omitempty"`
+	Decoders           []string                 `json:"decoders,omitempty"`
+	RetryAfterDefaults map[string]time.Duration `json:"retry_after_defaults,omitempty"`
+	StatusCodeMapping  map[string]int           `json:"status_code_mapping,omitempty"`
+}
+
+// Config returns a copy of the API's current configuration.
+func (a *API) Config() APIConfig {
+	if a == nil {
+		// a nil API responds with pretty printed json, see Respond.
+		return APIConfig{PrettyJSON: true}
+	}
+
+	c := APIConfig{
+		PrettyJSON:        a.prettyJSON,
+		EncodeGZIP:        a.encodeGZIP,
+		Envelope:          a.envelope,
+		ETag:              a.etag,
+		GZIPContentLength: a.gzipContentLength,
+		GZIPLevel:         a.gzipLevel,
+		GZIPPredicate:     a.gzipPredicate != nil,
+		JSONKeyResolver:   a.jsonKeyResolver != nil,
+		StrictJSON:        a.strictJSON,
+		SingleJSONValue:   a.singleJSONValue,
+		MaxBodyBytes:      a.maxBodyBytes,
+		AllowEmptyBody:    a.allowEmptyBody,
+		ProblemJSON:       a.problemJSON,
+		CompressMinSize:   a.compressMinSize,
+		CompressMinSaving: a.compressMinSaving,
+	}
+	c.Compression = append(c.Compression, a.compression...)
+	for mediaType := range a.encoders {
+		c.Encoders = append(c.Encoders, mediaType)
+	}
+	sort.Strings(c.Encoders)
+	for mediaType := range a.decoderMediaTypes {
+		c.Decoders = append(c.Decoders, mediaType)
+	}
+	sort.Strings(c.Decoders)
+	if len(a.retryAfter) > 0 {
+		c.RetryAfterDefaults = make(map[string]time.Duration, len(a.retryAfter))
+		for code, d := range a.retryAfter {
+			c.RetryAfterDefaults[code] = d
+		}
+	}
+	if len(a.statusCodes) > 0 {
+		c.StatusCodeMapping = make(map[string]int, len(a.statusCodes))
+		for code, status := range a.statusCodes {
+			c.StatusCodeMapping[code] = status
+		}
+	}
+	return c
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRespondHEAD(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []APIOptFn
+		encoding string
+	}{
+		{name: "uncompressed"},
+		{name: "gzip", opts: []APIOptFn{WithEncodeGZIP()}, encoding: "gzip"},
+		{name: "gzip with content length", opts: []APIOptFn{WithEncodeGZIP(), WithGZIPContentLength()}, encoding: "gzip"},
+		{name: "negotiated gzip", opts: []APIOptFn{WithCompression("gzip")}, encoding: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := NewAPI(tt.opts...)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				api.Respond(w, r, http.StatusOK, map[string]string{"data": strings.Repeat("transport ", 50)})
+			}))
+			defer srv.Close()
+			// keep the client from decompressing, so Content-Length is
+			// the one of the body on the wire.
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+			do := func(method string) (*http.Response, []byte) {
+				req, err := http.NewRequest(method, srv.URL, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Accept-Encoding", "gzip")
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp, body
+			}
+
+			// the server discards the body of HEAD responses, so check that
+			// Respond writes none in the first place.
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodHead, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			srv.Config.Handler.ServeHTTP(w, r)
+			if w.Body.Len() != 0 {
+				t.Errorf("Respond wrote %d body bytes for HEAD, want none", w.Body.Len())
+			}
+
+			get, getBody := do(http.MethodGet)
+			head, headBody := do(http.MethodHead)
+
+			if len(headBody) != 0 {
+				t.Errorf("HEAD body = %q, want empty", headBody)
+			}
+			if head.StatusCode != get.StatusCode {
+				t.Errorf("HEAD status = %d, want %d", head.StatusCode, get.StatusCode)
+			}
+			if head.ContentLength != int64(len(getBody)) || get.ContentLength != int64(len(getBody)) {
+				t.Errorf("Content-Length HEAD = %d, GET = %d, want %d", head.ContentLength, get.ContentLength, len(getBody))
+			}
+			if got := get.Header.Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("GET Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			for _, key := range []string{"Content-Type", "Content-Encoding", "Vary"} {
+				if got, want := head.Header.Get(key), get.Header.Get(key); got != want {
+					t.Errorf("HEAD %s = %q, want %q as for GET", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRespondGZIP(b *testing.B) {
+	api := NewAPI(WithEncodeGZIP(), WithPrettyJSON(false))
+	v := map[string]string{"data": strings.Repeat("transport ", 100)}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		api.Respond(httptest.NewRecorder(), r, http.StatusOK, v)
+	}
+}
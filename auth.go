@@ -0,0 +1,246 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/deepauto-io/errors"
+)
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the ID of the authenticated
+// principal. Auth validators set it so that later middleware, such as
+// PrincipalRateLimit, can tell requests of different users apart.
+func WithPrincipal(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, principalKey{}, id)
+}
+
+// PrincipalFromContext returns the principal ID stored on ctx by WithPrincipal.
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(principalKey{}).(string)
+	return id, ok && id != ""
+}
+
+// TokenExtractor reads an authentication token from a request. The
+// Authorization header, a cookie and a query parameter are the possible
+// sources and each of them is enabled individually.
+type TokenExtractor struct {
+	schemes []string
+	header  bool
+	cookie  string
+	query   string
+}
+
+// TokenExtractorOptFn is a functional option for setting fields on the TokenExtractor type.
+type TokenExtractorOptFn func(*TokenExtractor)
+
+// WithTokenSchemes sets the Authorization schemes accepted by the extractor,
+// e.g. "Bearer" or "Token". Schemes are matched case-insensitively.
+func WithTokenSchemes(schemes ...string) TokenExtractorOptFn {
+	return func(e *TokenExtractor) {
+		e.schemes = schemes
+	}
+}
+
+// WithoutTokenHeader stops the extractor from reading the Authorization header.
+func WithoutTokenHeader() TokenExtractorOptFn {
+	return func(e *TokenExtractor) {
+		e.header = false
+	}
+}
+
+// WithTokenCookie makes the extractor read the token from the named cookie.
+func WithTokenCookie(name string) TokenExtractorOptFn {
+	return func(e *TokenExtractor) {
+		e.cookie = name
+	}
+}
+
+// WithTokenQueryParam makes the extractor read the token from the named query
+// parameter, e.g. for download links that cannot carry headers.
+func WithTokenQueryParam(name string) TokenExtractorOptFn {
+	return func(e *TokenExtractor) {
+		e.query = name
+	}
+}
+
+// NewTokenExtractor creates a new TokenExtractor. By default it only reads
+// Bearer tokens from the Authorization header.
+func NewTokenExtractor(opts ...TokenExtractorOptFn) *TokenExtractor {
+	e := TokenExtractor{
+		schemes: []string{"Bearer"},
+		header:  true,
+	}
+	for _, o := range opts {
+		o(&e)
+	}
+	return &e
+}
+
+// Extract returns the token from the first enabled source that carries one,
+// checking the Authorization header, then the cookie, then the query parameter.
+func (e *TokenExtractor) Extract(r *http.Request) (string, bool) {
+	_, token, ok := e.extract(r)
+	return token, ok
+}
+
+// extract is Extract also returning the scheme of a token taken from the
+// Authorization header, spelled as configured, or "" for other sources.
+func (e *TokenExtractor) extract(r *http.Request) (scheme, token string, ok bool) {
+	if e.header {
+		if scheme, token, ok := parseAuthorization(r.Header.Get("Authorization")); ok {
+			for _, s := range e.schemes {
+				if strings.EqualFold(s, scheme) {
+					return s, token, true
+				}
+			}
+		}
+	}
+	if e.cookie != "" {
+		if c, err := r.Cookie(e.cookie); err == nil && c.Value != "" {
+			return "", c.Value, true
+		}
+	}
+	if e.query != "" {
+		if token := r.URL.Query().Get(e.query); token != "" {
+			return "", token, true
+		}
+	}
+	return "", "", false
+}
+
+// challenge returns the WWW-Authenticate challenge for the extractor.
+func (e *TokenExtractor) challenge() string {
+	if len(e.schemes) == 0 {
+		return "Bearer"
+	}
+	return e.schemes[0]
+}
+
+// TokenAuth returns a middleware that authenticates requests with the token
+// found by e. validate checks the token and returns the context the next
+// handler runs with, e.g. one carrying the principal (see WithPrincipal) or
+// the token's claims. Requests without a token, or whose token fails
+// validation, are answered with an errors.EUnauthorized error and a
+// WWW-Authenticate challenge.
+func TokenAuth(e *TokenExtractor, validate func(ctx context.Context, token string) (context.Context, error)) Middleware {
+	return authenticate(e, []string{e.challenge()}, func(ctx context.Context, _, token string) (context.Context, error) {
+		return validate(ctx, token)
+	})
+}
+
+// authenticate returns the middleware of TokenAuth and Auth, validating the
+// scheme and token e extracts and answering failures with the challenges.
+func authenticate(e *TokenExtractor, challenges []string, validate func(ctx context.Context, scheme, token string) (context.Context, error)) Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			scheme, token, ok := e.extract(r)
+			if !ok {
+				writeUnauthorized(w, r, challenges, nil)
+				return
+			}
+
+			ctx, err := validate(r.Context(), scheme, token)
+			if err != nil {
+				writeUnauthorized(w, r, challenges, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// parseAuthorization splits an Authorization header value into its scheme
+// and credentials.
+func parseAuthorization(header string) (scheme, credentials string, ok bool) {
+	scheme, credentials, ok = strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return "", "", false
+	}
+	credentials = strings.TrimSpace(credentials)
+	return scheme, credentials, scheme != "" && credentials != ""
+}
+
+// writeUnauthorized writes err, or a generic errors.EUnauthorized error when
+// err is nil or not a platform error, adding the challenges as
+// WWW-Authenticate headers when the response is a 401.
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, challenges []string, err error) {
+	if !isPlatformError(err) {
+		msg := "missing credentials"
+		if err != nil {
+			msg = "invalid credentials"
+		}
+		err = &errors.Error{
+			Code: errors.EUnauthorized,
+			Msg:  msg,
+		}
+	}
+
+	body, status, headers := BuildErrorBody(r.Context(), err)
+	if status == http.StatusUnauthorized {
+		for _, c := range challenges {
+			headers.Add("WWW-Authenticate", c)
+		}
+	}
+	writeErrorResponse(w, body, status, headers)
+}
+
+// AuthValidator validates the credentials of the Authorization header for
+// Auth.
+type AuthValidator interface {
+	// Challenges returns the WWW-Authenticate challenges of the accepted
+	// schemes, e.g. `Basic realm="api"` or "Bearer". The first word of a
+	// challenge is its scheme.
+	Challenges() []string
+	// Validate checks the credentials of an accepted scheme, which is given
+	// as spelled in the challenge, and returns the context the next handler
+	// runs with, e.g. one carrying the principal (see WithPrincipal) or
+	// claims. For the Basic scheme see ParseBasicCredentials.
+	Validate(ctx context.Context, scheme, credentials string) (context.Context, error)
+}
+
+// Auth is TokenAuth for validators accepting several Authorization schemes,
+// such as Basic and Bearer, and telling them apart. Requests without
+// credentials of an accepted scheme, or whose credentials fail validation,
+// are answered with an errors.EUnauthorized error and the validator's
+// WWW-Authenticate challenges.
+func Auth(validator AuthValidator) Middleware {
+	challenges := validator.Challenges()
+	schemes := make([]string, 0, len(challenges))
+	for _, c := range challenges {
+		scheme, _, _ := strings.Cut(c, " ")
+		schemes = append(schemes, scheme)
+	}
+	e := NewTokenExtractor(WithTokenSchemes(schemes...))
+	return authenticate(e, challenges, validator.Validate)
+}
+
+// ParseBasicCredentials decodes the credentials of the Basic scheme into a
+// user ID and password.
+func ParseBasicCredentials(credentials string) (user, password string, ok bool) {
+	b, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
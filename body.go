@@ -0,0 +1,196 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	errorsv2 "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/deepauto-io/errors"
+)
+
+// defaultSlowBodyGracePeriod is how long a body may arrive slower than the
+// minimum rate by default.
+const defaultSlowBodyGracePeriod = 5 * time.Second
+
+// SlowBodyOptions configures RejectSlowBodies.
+type SlowBodyOptions struct {
+	// MaxDuration is the longest reading the whole body may take. Zero
+	// disables the limit.
+	MaxDuration time.Duration
+	// MinRate is the minimum average throughput of the body in bytes per
+	// second. Zero disables the limit.
+	MinRate float64
+	// GracePeriod is how long the body may arrive slower than MinRate, e.g.
+	// while the connection warms up. Defaults to 5 seconds.
+	GracePeriod time.Duration
+}
+
+// RejectSlowBodies returns a middleware defending against slowloris style
+// clients that trickle a request body to tie up a connection. Reading a body
+// that takes longer than opts.MaxDuration, or arrives slower than
+// opts.MinRate, fails with an ERequestTimeout error (408) and cancels the
+// request context so that work started for the request stops too.
+//
+// The maximum duration is enforced with a read deadline on the connection
+// when the http.ResponseWriter supports it, so a client sending nothing at
+// all is cut off as well.
+func RejectSlowBodies(opts SlowBodyOptions) Middleware {
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = defaultSlowBodyGracePeriod
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
+
+			start := time.Now()
+			rc := http.NewResponseController(w)
+			if opts.MaxDuration > 0 {
+				_ = rc.SetReadDeadline(start.Add(opts.MaxDuration))
+			}
+
+			r = r.WithContext(ctx)
+			r.Body = &slowBodyReader{
+				rc:     r.Body,
+				opts:   opts,
+				start:  start,
+				cancel: cancel,
+				clearDeadline: func() {
+					_ = rc.SetReadDeadline(time.Time{})
+				},
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+type slowBodyReader struct {
+	rc            io.ReadCloser
+	opts          SlowBodyOptions
+	start         time.Time
+	read          int64
+	err           error
+	cancel        context.CancelCauseFunc
+	clearDeadline func()
+}
+
+func (b *slowBodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err := b.rc.Read(p)
+	b.read += int64(n)
+
+	elapsed := time.Since(b.start)
+	tooLong := b.opts.MaxDuration > 0 && elapsed > b.opts.MaxDuration
+	tooSlow := b.opts.MinRate > 0 && elapsed > b.opts.GracePeriod &&
+		float64(b.read)/elapsed.Seconds() < b.opts.MinRate
+	if err == io.EOF {
+		b.clearDeadline()
+		if !tooLong {
+			return n, err
+		}
+	}
+	if tooLong || tooSlow {
+		b.err = &errors.Error{
+			Code: ERequestTimeout,
+			Msg:  "request body was sent too slowly",
+		}
+		b.cancel(b.err)
+		return n, b.err
+	}
+	return n, err
+}
+
+func (b *slowBodyReader) Close() error {
+	return b.rc.Close()
+}
+
+// MaxBodyBytes returns a middleware limiting request bodies to n bytes,
+// protecting handlers that read the body themselves as well as the Decode
+// methods, see also WithMaxBodyBytes. Requests announcing a larger
+// Content-Length are rejected with an errors.ETooLarge error (413) straight
+// away. Otherwise reading past the limit fails with an errors.ETooLarge
+// error, and the middleware writes the 413 if the handler responds with
+// nothing. Placed inside LoggingMW, the logged body is truncated at the
+// limit as well.
+func MaxBodyBytes(n int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				WriteErrorResponse(r.Context(), w, errors.ETooLarge, fmt.Sprintf("request body exceeds %d bytes", n))
+				return
+			}
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body := &maxBodyReader{
+				rc:    http.MaxBytesReader(w, r.Body, n),
+				limit: n,
+			}
+			r.Body = body
+			srw := NewStatusResponseWriter(w)
+			next.ServeHTTP(srw, r)
+
+			if body.exceeded && srw.statusCode == 0 && srw.responseBytes == 0 {
+				WriteErrorResponse(r.Context(), w, errors.ETooLarge, fmt.Sprintf("request body exceeds %d bytes", n))
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// maxBodyReader turns the error of an http.MaxBytesReader into a platform
+// error, which the Decode methods pass through unchanged.
+type maxBodyReader struct {
+	rc       io.ReadCloser
+	limit    int64
+	exceeded bool
+}
+
+func (b *maxBodyReader) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	var maxErr *http.MaxBytesError
+	if errorsv2.As(err, &maxErr) {
+		b.exceeded = true
+		err = &errors.Error{
+			Code: errors.ETooLarge,
+			Msg:  fmt.Sprintf("request body exceeds %d bytes", b.limit),
+			Err:  err,
+		}
+	}
+	return n, err
+}
+
+func (b *maxBodyReader) Close() error {
+	return b.rc.Close()
+}
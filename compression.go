@@ -0,0 +1,198 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"compress/zlib"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// CompressorFunc returns a writer compressing what is written to it into w.
+// Closing the returned writer must flush the compressed stream without
+// closing w.
+type CompressorFunc func(w io.Writer) io.WriteCloser
+
+// WithCompressor registers fn as the compressor for the content coding,
+// e.g. "br" or "zstd" backed by a third party package. Builtin codings such
+// as "gzip" may be overridden the same way.
+func WithCompressor(coding string, fn CompressorFunc) APIOptFn {
+	return func(api *API) {
+		if api.compressors == nil {
+			api.compressors = make(map[string]CompressorFunc)
+		}
+		api.compressors[coding] = fn
+	}
+}
+
+// WithCompression sets the content codings the API offers, in order of
+// preference, e.g. WithCompression("br", "gzip"). Respond then compresses
+// responses with the coding the request's Accept-Encoding header prefers,
+// falling back to the order given here for equally acceptable codings.
+// Responses to requests accepting none of them are written uncompressed.
+// Codings other than gzip and deflate need a compressor registered with
+// WithCompressor; offering deflate besides gzip serves older clients that
+// only accept deflate.
+//
+// WithCompression takes precedence over WithEncodeGZIP, which compresses
+// regardless of the request.
+func WithCompression(codings ...string) APIOptFn {
+	return func(api *API) {
+		api.compression = codings
+	}
+}
+
+// WithCompressMinSize skips compressing responses smaller than n bytes,
+// whose compression costs CPU and rarely saves anything, and may even
+// inflate the body. Responses of unknown size, such as those streamed by
+// RespondReader, are compressed regardless. Defaults to 0, compressing every
+// response.
+func WithCompressMinSize(n int) APIOptFn {
+	return func(api *API) {
+		api.compressMinSize = n
+	}
+}
+
+// WithAdaptiveCompression compresses responses into a buffer first and only
+// sends them compressed when that makes them at least minSaving smaller,
+// e.g. 0.1 for a 10% reduction, and uncompressed otherwise. Already dense or
+// tiny payloads can grow when compressed; this guarantees compression pays
+// off at the cost of buffering, like WithGZIPContentLength. Disabled by
+// default.
+func WithAdaptiveCompression(minSaving float64) APIOptFn {
+	return func(api *API) {
+		api.compressMinSaving = minSaving
+	}
+}
+
+// contentCoding returns the coding to compress the response to r with, or ""
+// to write it uncompressed. r is nil when there is no request to consult.
+func (a *API) contentCoding(w http.ResponseWriter, r *http.Request, status int, contentType string, size int) string {
+	if a == nil || (size >= 0 && size < a.compressMinSize) {
+		return ""
+	}
+	if len(a.compression) == 0 {
+		if a.shouldGZIP(r, status, contentType, size) {
+			return "gzip"
+		}
+		return ""
+	}
+	if r == nil {
+		return ""
+	}
+
+	// the response differs with the request's Accept-Encoding, whether it is
+	// compressed or not.
+	addHeaderOnce(w.Header(), "Vary", "Accept-Encoding")
+	if a.gzipPredicate != nil && !a.gzipPredicate(r, status, contentType, size) {
+		return ""
+	}
+
+	offers := make([]string, 0, len(a.compression))
+	for _, coding := range a.compression {
+		if a.compressor(coding) != nil {
+			offers = append(offers, coding)
+		}
+	}
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"), offers)
+}
+
+// compressor returns the compressor of coding, or nil if there is none.
+func (a *API) compressor(coding string) CompressorFunc {
+	if fn, ok := a.compressors[coding]; ok {
+		return fn
+	}
+	switch coding {
+	case "gzip":
+		return a.newGZIPWriter
+	case "deflate":
+		return a.newDeflateWriter
+	}
+	return nil
+}
+
+// deflateWriters pools zlib writers like gzipWriters pools gzip writers.
+var deflateWriters [zlib.BestCompression - zlib.HuffmanOnly + 1]sync.Pool
+
+func init() {
+	for i := range deflateWriters {
+		level := i + zlib.HuffmanOnly
+		deflateWriters[i].New = func() interface{} {
+			zw, _ := zlib.NewWriterLevel(io.Discard, level)
+			return zw
+		}
+	}
+}
+
+// newDeflateWriter returns a pooled writer compressing to w in the zlib
+// format, which is what the deflate content coding means despite its name,
+// with the level set with WithGZIPLevel. It is returned to the pool when
+// closed, so it must not be used afterwards.
+func (a *API) newDeflateWriter(w io.Writer) io.WriteCloser {
+	pool := &deflateWriters[a.gzipLevel-zlib.HuffmanOnly]
+	zw := pool.Get().(*zlib.Writer)
+	zw.Reset(w)
+	return &pooledDeflateWriter{Writer: zw, pool: pool}
+}
+
+type pooledDeflateWriter struct {
+	*zlib.Writer
+	pool *sync.Pool
+}
+
+func (p *pooledDeflateWriter) Close() error {
+	if p.Writer == nil {
+		return nil
+	}
+	err := p.Writer.Close()
+	// drop the reference to the response writer before pooling.
+	p.Writer.Reset(io.Discard)
+	p.pool.Put(p.Writer)
+	p.Writer = nil
+	return err
+}
+
+// negotiateEncoding returns the offer the Accept-Encoding header prefers, or
+// "" when it accepts none of them. A missing header accepts none, since
+// clients that can decompress say so.
+func negotiateEncoding(header string, offers []string) string {
+	if header == "" {
+		return ""
+	}
+
+	items := parseQualityList(header)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, explicit, wildcard := 0.0, false, -1.0
+		for _, item := range items {
+			switch item.value {
+			case offer:
+				q, explicit = item.q, true
+			case "*":
+				wildcard = item.q
+			}
+		}
+		if !explicit && wildcard >= 0 {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// AllowContentEncodings returns a middleware that rejects requests whose
+// Content-Encoding is not one of encodings with an EUnsupportedMediaType
+// error (415). A request without a Content-Encoding is treated as
+// "identity", so include it to accept uncompressed bodies. Rejecting early
+// is cheaper and safer than failing half way through decompression.
+func AllowContentEncodings(encodings ...string) Middleware {
+	allowed := make(map[string]bool, len(encodings))
+	for _, e := range encodings {
+		allowed[strings.ToLower(e)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			for _, e := range contentEncodings(r) {
+				if !allowed[e] {
+					WriteErrorResponse(r.Context(), w, EUnsupportedMediaType, fmt.Sprintf("unsupported content encoding: %q", e))
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// contentEncodings returns the lower cased codings listed in the request's
+// Content-Encoding headers, or "identity" if there are none.
+func contentEncodings(r *http.Request) []string {
+	var encodings []string
+	for _, v := range r.Header.Values("Content-Encoding") {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+				encodings = append(encodings, e)
+			}
+		}
+	}
+	if len(encodings) == 0 {
+		return []string{"identity"}
+	}
+	return encodings
+}
+
+// JSONAPI returns a middleware enforcing a JSON only API contract. Requests
+// whose Accept header does not allow application/json are rejected with an
+// ENotAcceptable error (406), and POST, PUT and PATCH requests whose
+// Content-Type is not application/json with an EUnsupportedMediaType error
+// (415).
+func JSONAPI() Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if accept := r.Header.Get("Accept"); Negotiate(accept, []string{"application/json"}) == "" {
+				WriteErrorResponse(r.Context(), w, ENotAcceptable, fmt.Sprintf("unsupported accept header: %q", accept))
+				return
+			}
+
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch:
+				if !checkContentType(w, r, jsonOnly) {
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+var jsonOnly = map[string]bool{jsonMediaType: true}
+
+// RequireContentType returns a middleware rejecting requests with a body
+// whose Content-Type is not one of types, ignoring parameters such as
+// charset, with an EUnsupportedMediaType error (415), before they fail to
+// decode. GET, HEAD, OPTIONS and TRACE requests, and requests declaring an
+// empty body, are not checked.
+func RequireContentType(types ...string) Middleware {
+	allowed := make(map[string]bool, len(types))
+	for _, t := range types {
+		allowed[strings.ToLower(t)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if !safeMethod(r.Method) && r.ContentLength != 0 && !checkContentType(w, r, allowed) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// checkContentType reports whether the media type of r is allowed, and
+// writes an EUnsupportedMediaType error when it is not.
+func checkContentType(w http.ResponseWriter, r *http.Request, allowed map[string]bool) bool {
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); !allowed[mediaType] {
+		WriteErrorResponse(r.Context(), w, EUnsupportedMediaType, fmt.Sprintf("invalid media type: %q", contentType))
+		return false
+	}
+	return true
+}
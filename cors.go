@@ -0,0 +1,159 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NoOriginOptions decides how CORS answers an OPTIONS request that has no
+// Origin header, i.e. one that is not a CORS preflight request.
+type NoOriginOptions int
+
+const (
+	// NoOriginOptionsNoContent answers with 204 No Content and the allowed
+	// methods and headers, exactly like a preflight request. This is what
+	// SetCORS does.
+	NoOriginOptionsNoContent NoOriginOptions = iota
+	// NoOriginOptionsPassThrough hands the request to the next handler.
+	NoOriginOptionsPassThrough
+	// NoOriginOptionsMethodNotAllowed answers with 405 Method Not Allowed,
+	// like SkipOptions does.
+	NoOriginOptionsMethodNotAllowed
+)
+
+var (
+	defaultCORSMethods = []string{"POST", "GET", "OPTIONS", "PUT", "DELETE", "PATCH"}
+	defaultCORSHeaders = []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "Authorization", "User-Agent"}
+)
+
+// CORSOptions configures the CORS middleware.
+type CORSOptions struct {
+	// AllowedOrigins lists the origins allowed to make cross-origin requests,
+	// e.g. "https://app.example.com". An entry may contain one "*" wildcard,
+	// as in "https://*.example.com", and "*" alone allows every origin.
+	// Requests from other origins get no Access-Control-Allow-Origin header,
+	// so browsers refuse to expose the response. An empty list allows none.
+	AllowedOrigins []string
+	// AllowedMethods is answered to preflight requests. Defaults to POST,
+	// GET, OPTIONS, PUT, DELETE and PATCH.
+	AllowedMethods []string
+	// AllowedHeaders is answered to preflight requests. Defaults to Accept,
+	// Content-Type, Content-Length, Accept-Encoding, Authorization and
+	// User-Agent.
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers, besides the CORS-safelisted
+	// ones, that scripts are allowed to read.
+	ExposedHeaders []string
+	// AllowCredentials allows requests with cookies or HTTP authentication.
+	AllowCredentials bool
+	// MaxAge is how long, in seconds, browsers may cache a preflight
+	// response. Zero leaves it to the browser.
+	MaxAge int
+	// NoOriginOptions decides how OPTIONS requests without an Origin header
+	// are answered. Defaults to NoOriginOptionsNoContent.
+	NoOriginOptions NoOriginOptions
+}
+
+// CORS returns a middleware that sets the CORS response headers and answers
+// preflight requests. Unlike combining SetCORS and SkipOptions, whose result
+// depends on their order, the handling of OPTIONS requests without an Origin
+// is an explicit choice in opts.
+//
+// Allowed origins are reflected in Access-Control-Allow-Origin rather than
+// answered with "*", which browsers reject for credentialed requests.
+func CORS(opts CORSOptions) Middleware {
+	methods, headers := opts.AllowedMethods, opts.AllowedHeaders
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	exposeHeaders := strings.Join(opts.ExposedHeaders, ", ")
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			allowed := origin != "" && originAllowed(opts.AllowedOrigins, origin)
+			if origin != "" {
+				// the response depends on the origin, don't let caches serve
+				// it to other origins.
+				w.Header().Add("Vary", "Origin")
+			}
+			if allowed {
+				// Access-Control-Allow-Origin must be present in every response
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				if opts.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+				if exposeHeaders != "" && r.Method != http.MethodOptions {
+					w.Header().Set("Access-Control-Expose-Headers", exposeHeaders)
+				}
+			}
+			if r.Method != http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if origin == "" {
+				switch opts.NoOriginOptions {
+				case NoOriginOptionsPassThrough:
+					next.ServeHTTP(w, r)
+					return
+				case NoOriginOptionsMethodNotAllowed:
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+			} else if !allowed {
+				// the missing allow headers make the browser fail the preflight.
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			// allow and stop processing in pre-flight requests
+			w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+			if opts.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(opts.MaxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// originAllowed reports whether origin matches one of the allowed patterns.
+func originAllowed(patterns []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(pattern, "*")
+		if ok && len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
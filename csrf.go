@@ -0,0 +1,113 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/deepauto-io/errors"
+)
+
+const (
+	defaultCSRFCookieName = "csrf_token"
+	defaultCSRFHeaderName = "X-CSRF-Token"
+	defaultCSRFTokenTTL   = 12 * time.Hour
+)
+
+// CSRFOptions configures the CSRF middleware.
+type CSRFOptions struct {
+	// CookieName is the name of the cookie holding the token. Defaults to
+	// "csrf_token".
+	CookieName string
+	// HeaderName is the request header that must repeat the token on unsafe
+	// requests. Defaults to "X-CSRF-Token".
+	HeaderName string
+	// TTL is how long the token cookie lives. Defaults to 12 hours.
+	TTL time.Duration
+	// Secure restricts the token cookie to HTTPS.
+	Secure bool
+}
+
+// CSRF returns a middleware protecting cookie authenticated endpoints from
+// cross-site request forgery with the double-submit cookie pattern. Requests
+// without a token cookie are given one, readable by scripts of the site.
+// POST, PUT, PATCH and DELETE requests, and any other unsafe method, must
+// repeat the cookie's token in the header, which other sites cannot do, or
+// are rejected with an errors.EForbidden error. GET, HEAD, OPTIONS and TRACE
+// requests, including CORS preflight requests, are not checked.
+func CSRF(opts CSRFOptions) Middleware {
+	if opts.CookieName == "" {
+		opts.CookieName = defaultCSRFCookieName
+	}
+	if opts.HeaderName == "" {
+		opts.HeaderName = defaultCSRFHeaderName
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultCSRFTokenTTL
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			var token string
+			if c, err := r.Cookie(opts.CookieName); err == nil {
+				token = c.Value
+			}
+			if token == "" {
+				http.SetCookie(w, &http.Cookie{
+					Name:     opts.CookieName,
+					Value:    newCSRFToken(),
+					Path:     "/",
+					MaxAge:   int(opts.TTL / time.Second),
+					Secure:   opts.Secure,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			if !safeMethod(r.Method) {
+				header := r.Header.Get(opts.HeaderName)
+				if token == "" || subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+					WriteErrorResponse(r.Context(), w, errors.EForbidden, "CSRF token missing or invalid")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// safeMethod reports whether method is safe, i.e. read-only, per RFC 9110.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func newCSRFToken() string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("transport: reading random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
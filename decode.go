@@ -0,0 +1,397 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/xml"
+	errorsv2 "errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/deepauto-io/errors"
+)
+
+// DecoderFunc returns a Decoder reading from r.
+type DecoderFunc func(r io.Reader) Decoder
+
+// WithDecoder registers fn as the decoder of the encoding, e.g. "msgpack",
+// used by DecodeRequest and DecodeAny for request bodies of mediaType.
+// Together with WithEncoder it plugs a format in without importing it into
+// this package. Builtin encodings may be overridden the same way.
+func WithDecoder(mediaType, encoding string, fn DecoderFunc) APIOptFn {
+	return func(api *API) {
+		if api.decoders == nil {
+			api.decoders = make(map[string]DecoderFunc)
+			api.decoderMediaTypes = make(map[string]string)
+		}
+		api.decoders[encoding] = fn
+		api.decoderMediaTypes[mediaType] = encoding
+	}
+}
+
+// MsgpackMediaType is the media type of msgpack, see DecodeMsgpack.
+const MsgpackMediaType = "application/msgpack"
+
+// bodyDecoders creates the decoders of the builtin encodings DecodeRequest
+// and DecodeAny support, by name.
+var bodyDecoders = map[string]func(a *API, r io.Reader) Decoder{
+	"json": (*API).jsonDecoder,
+	"xml": func(_ *API, r io.Reader) Decoder {
+		return xml.NewDecoder(r)
+	},
+	"gob": func(_ *API, r io.Reader) Decoder {
+		return gob.NewDecoder(r)
+	},
+	"form": func(_ *API, r io.Reader) Decoder {
+		return &urlEncodedDecoder{r: r}
+	},
+}
+
+// newDecoder returns the constructor of the decoder of encoding, registered
+// or builtin.
+func (a *API) newDecoder(encoding string) (DecoderFunc, bool) {
+	if a != nil {
+		if fn, ok := a.decoders[encoding]; ok {
+			return fn, true
+		}
+	}
+	fn, ok := bodyDecoders[encoding]
+	if !ok {
+		return nil, false
+	}
+	return func(r io.Reader) Decoder {
+		return fn(a, r)
+	}, true
+}
+
+// mediaTypeEncodings maps request content types to bodyDecoders.
+var mediaTypeEncodings = map[string]string{
+	jsonMediaType: "json",
+	xmlMediaType:  "xml",
+	"text/xml":    "xml",
+	gobMediaType:  "gob",
+	formMediaType: "form",
+}
+
+// requestEncoding returns the encoding of r's body according to its
+// Content-Type, and whether it is known.
+func (a *API) requestEncoding(r *http.Request) (string, bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if a != nil {
+		if encoding, ok := a.decoderMediaTypes[mediaType]; ok {
+			return encoding, true
+		}
+	}
+	encoding, ok := mediaTypeEncodings[mediaType]
+	return encoding, ok
+}
+
+// requestBody returns the body of r, decompressed according to its
+// Content-Encoding. Unless the API has a body limit of its own, which then
+// applies to the decompressed body, decompressed bodies are limited to
+// 10 MiB so that a small gzip bomb cannot expand without bound.
+func (a *API) requestBody(r *http.Request) (io.ReadCloser, error) {
+	zr, err := decompressBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if zr == nil {
+		return r.Body, nil
+	}
+	if a != nil && a.maxBodyBytes > 0 {
+		return zr, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: &maxBytesReader{
+			r:         zr,
+			limit:     defaultMaxDecompressedBytes,
+			remaining: defaultMaxDecompressedBytes,
+		},
+		Closer: zr,
+	}, nil
+}
+
+// resetValue zeroes the value v points to, so a failed decoding attempt
+// leaves nothing behind for the next one.
+func resetValue(v interface{}) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+	}
+}
+
+func (a *API) jsonDecoder(r io.Reader) Decoder {
+	strict := a != nil && a.strictJSON
+	if a != nil && a.jsonKeyResolver != nil {
+		return &keyResolvingDecoder{
+			dec:     json.NewDecoder(r),
+			resolve: a.jsonKeyResolver,
+			strict:  strict,
+		}
+	}
+	dec := json.NewDecoder(r)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec
+}
+
+// keyResolvingDecoder decodes JSON into a generic value first, renames every
+// object key with resolve and only then decodes into the destination, so
+// keys are matched against struct tags after normalization.
+type keyResolvingDecoder struct {
+	dec     *json.Decoder
+	resolve func(key string) string
+	strict  bool
+}
+
+func (d *keyResolvingDecoder) Decode(v interface{}) error {
+	d.dec.UseNumber()
+
+	var raw interface{}
+	if err := d.dec.Decode(&raw); err != nil {
+		return err
+	}
+
+	resolved, err := resolveKeys(raw, d.resolve)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(resolved)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if d.strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// trailingJSON returns an errors.EInvalid error when dec, a JSON decoder,
+// has more data after the value it decoded. Other decoders are ignored.
+func trailingJSON(dec Decoder) error {
+	var jd *json.Decoder
+	switch d := dec.(type) {
+	case *json.Decoder:
+		jd = d
+	case *keyResolvingDecoder:
+		jd = d.dec
+	default:
+		return nil
+	}
+
+	var extra json.RawMessage
+	err := jd.Decode(&extra)
+	if err == io.EOF {
+		return nil
+	}
+	var maxErr *http.MaxBytesError
+	if errorsv2.As(err, &maxErr) {
+		return err
+	}
+	return &errors.Error{
+		Code: errors.EInvalid,
+		Msg:  "request body must contain a single JSON value",
+	}
+}
+
+// resolveKeys renames the keys of all objects nested in v. Two keys of an
+// object resolving to the same name are rejected with an errors.EInvalid
+// error, since which of their values to keep would be arbitrary.
+func resolveKeys(v interface{}, resolve func(key string) string) (interface{}, error) {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, val := range vv {
+			name := resolve(k)
+			if _, ok := m[name]; ok {
+				return nil, &errors.Error{
+					Code: errors.EInvalid,
+					Msg:  fmt.Sprintf("duplicate key after normalization: %.64q", name),
+				}
+			}
+			resolved, err := resolveKeys(val, resolve)
+			if err != nil {
+				return nil, err
+			}
+			m[name] = resolved
+		}
+		return m, nil
+	case []interface{}:
+		for i, val := range vv {
+			resolved, err := resolveKeys(val, resolve)
+			if err != nil {
+				return nil, err
+			}
+			vv[i] = resolved
+		}
+		return vv, nil
+	default:
+		return v, nil
+	}
+}
+
+// MapLimits bounds a free-form JSON object decoded by DecodeStringMap. Zero
+// values mean unlimited.
+type MapLimits struct {
+	// MaxKeys is the maximum number of keys.
+	MaxKeys int
+	// MaxKeyLength is the maximum length of a key in bytes.
+	MaxKeyLength int
+	// MaxValueLength is the maximum length of a value in bytes.
+	MaxValueLength int
+}
+
+// DecodeStringMap decodes a JSON object of strings, such as tags or metadata
+// that cannot be described by a struct, enforcing limits. Objects exceeding
+// the limits are rejected with an errors.EInvalid error. Combine it with
+// WithMaxBodyBytes to bound the total size as well.
+func (a *API) DecodeStringMap(r io.Reader, limits MapLimits) (map[string]string, error) {
+	var m map[string]string
+	if err := a.DecodeJSON(r, &m); err != nil {
+		return nil, err
+	}
+	if err := limits.check(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (l MapLimits) check(m map[string]string) error {
+	if l.MaxKeys > 0 && len(m) > l.MaxKeys {
+		return &errors.Error{
+			Code: errors.EInvalid,
+			Msg:  fmt.Sprintf("too many keys: %d, at most %d allowed", len(m), l.MaxKeys),
+		}
+	}
+	for k, v := range m {
+		if l.MaxKeyLength > 0 && len(k) > l.MaxKeyLength {
+			return &errors.Error{
+				Code: errors.EInvalid,
+				Msg:  fmt.Sprintf("key %.64q exceeds %d bytes", k, l.MaxKeyLength),
+			}
+		}
+		if l.MaxValueLength > 0 && len(v) > l.MaxValueLength {
+			return &errors.Error{
+				Code: errors.EInvalid,
+				Msg:  fmt.Sprintf("value of key %.64q exceeds %d bytes", k, l.MaxValueLength),
+			}
+		}
+	}
+	return nil
+}
+
+// limitBody applies the API's body limit to r, if any.
+func (a *API) limitBody(r io.Reader) io.Reader {
+	if a == nil || a.maxBodyBytes <= 0 {
+		return r
+	}
+	return &maxBytesReader{
+		r:         r,
+		limit:     a.maxBodyBytes,
+		remaining: a.maxBodyBytes,
+	}
+}
+
+// maxBytesReader is like http.MaxBytesReader but works on any reader and
+// leaves the connection alone. Reading past the limit fails with an
+// *http.MaxBytesError.
+type maxBytesReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+}
+
+func (l *maxBytesReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, &http.MaxBytesError{Limit: l.limit}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// read one byte past the limit to tell a body of exactly limit bytes
+	// from a larger one.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) <= l.remaining {
+		l.remaining -= int64(n)
+		return n, err
+	}
+	n = int(l.remaining)
+	l.remaining = -1
+	return n, &http.MaxBytesError{Limit: l.limit}
+}
+
+// DecodeJSONArray decodes a JSON array element by element, calling fn with
+// the index and raw JSON of each, so huge arrays are processed with bounded
+// memory and every element can be validated, e.g. with DecodeJSON, as it
+// arrives. Decoding stops at the first error, including those fn returns,
+// which goes through the unmarshal error function. Bodies that are not a
+// JSON array are rejected with an errors.EInvalid error.
+func (a *API) DecodeJSONArray(r io.Reader, fn func(index int, raw json.RawMessage) error) error {
+	dec := json.NewDecoder(a.limitBody(r))
+	tok, err := dec.Token()
+	if err == io.EOF {
+		if a != nil && a.allowEmptyBody {
+			return nil
+		}
+		return a.unmarshalErr("json", &errors.Error{
+			Code: errors.EInvalid,
+			Msg:  "request body is required",
+		})
+	} else if err != nil {
+		return a.unmarshalErr("json", err)
+	}
+	if tok != json.Delim('[') {
+		return a.unmarshalErr("json", &errors.Error{
+			Code: errors.EInvalid,
+			Msg:  "request body must be a JSON array",
+		})
+	}
+
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return a.unmarshalErr("json", err)
+		}
+		if err := fn(i, raw); err != nil {
+			return a.unmarshalErr("json", err)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return a.unmarshalErr("json", err)
+	}
+
+	if a != nil && a.singleJSONValue {
+		if err := trailingJSON(dec); err != nil {
+			return a.unmarshalErr("json", err)
+		}
+	}
+	return nil
+}
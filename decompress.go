@@ -0,0 +1,147 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/deepauto-io/errors"
+)
+
+// defaultMaxDecompressedBytes is the default limit of a decompressed
+// request body.
+const defaultMaxDecompressedBytes = 10 << 20
+
+// DecompressOptFn is a functional option for DecompressRequest.
+type DecompressOptFn func(*decompressOpts)
+
+type decompressOpts struct {
+	maxBytes int64
+}
+
+// WithMaxDecompressedBytes limits decompressed request bodies to n bytes.
+// Defaults to 10 MiB.
+func WithMaxDecompressedBytes(n int64) DecompressOptFn {
+	return func(o *decompressOpts) {
+		o.maxBytes = n
+	}
+}
+
+// DecompressRequest returns a middleware transparently decompressing gzip
+// request bodies, so handlers and the Decode methods read plain content.
+// Content-Encoding and Content-Length are removed from the request since
+// they no longer describe the body. Bodies in other encodings are rejected
+// with an EUnsupportedMediaType error (415), malformed gzip with an
+// errors.EInvalid error. Reading more than the decompressed size limit,
+// e.g. of a gzip bomb, fails with an errors.ETooLarge error (413), which is
+// written as the response unless the handler already responded.
+func DecompressRequest(opts ...DecompressOptFn) Middleware {
+	o := decompressOpts{maxBytes: defaultMaxDecompressedBytes}
+	for _, fn := range opts {
+		fn(&o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			body, err := decompressBody(r)
+			if err != nil {
+				writeError(r.Context(), w, err)
+				return
+			}
+			if body == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			limited := &maxBodyReader{
+				rc:    http.MaxBytesReader(w, body, o.maxBytes),
+				limit: o.maxBytes,
+			}
+			r.Body = limited
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+
+			srw := NewStatusResponseWriter(w)
+			next.ServeHTTP(srw, r)
+
+			if limited.exceeded && srw.statusCode == 0 && srw.responseBytes == 0 {
+				WriteErrorResponse(r.Context(), w, errors.ETooLarge, fmt.Sprintf("request body exceeds %d bytes", o.maxBytes))
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// decompressBody returns a reader of the decompressed body of r, or nil when
+// r is not compressed. Codings are undone in the reverse order of Content-Encoding.
+func decompressBody(r *http.Request) (io.ReadCloser, error) {
+	encodings := contentEncodings(r)
+	var body io.ReadCloser
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case "identity":
+		case "gzip", "x-gzip":
+			src := io.Reader(r.Body)
+			if body != nil {
+				src = body
+			}
+			zr, err := gzip.NewReader(src)
+			if err != nil {
+				return nil, invalidGZIP(err)
+			}
+			body = &gzipBody{zr: zr, body: r.Body}
+		default:
+			return nil, &errors.Error{
+				Code: EUnsupportedMediaType,
+				Msg:  fmt.Sprintf("unsupported content encoding: %q", encodings[i]),
+			}
+		}
+	}
+	return body, nil
+}
+
+// gzipBody reads a gzip compressed request body, reporting corrupt data as
+// errors.EInvalid.
+type gzipBody struct {
+	zr   *gzip.Reader
+	body io.Closer
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	n, err := b.zr.Read(p)
+	if err != nil && err != io.EOF && !isPlatformError(err) {
+		err = invalidGZIP(err)
+	}
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	_ = b.zr.Close()
+	return b.body.Close()
+}
+
+func invalidGZIP(err error) error {
+	return &errors.Error{
+		Code: errors.EInvalid,
+		Msg:  "malformed gzip request body",
+		Err:  err,
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"encoding/gob"
+	"encoding/xml"
+	"io"
+	"net/http"
+)
+
+const (
+	jsonMediaType = "application/json"
+	xmlMediaType  = "application/xml"
+	gobMediaType  = "application/x-gob"
+)
+
+// EncoderFunc encodes v to w.
+type EncoderFunc func(w io.Writer, v interface{}) error
+
+// GobEncoder is an EncoderFunc encoding values with encoding/gob, to be
+// registered with WithEncoder, e.g. for "application/x-gob".
+func GobEncoder(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+// XMLEncoder is an EncoderFunc encoding values with encoding/xml, preceded
+// by the standard XML header. It is used by RespondXML and can be
+// registered with WithEncoder for "application/xml".
+func XMLEncoder(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(v)
+}
+
+// builtinOffers are the media types Respond can encode without registering
+// an encoder, JSON first as the default.
+var builtinOffers = []string{jsonMediaType, xmlMediaType, gobMediaType}
+
+// WithEncoder registers fn as the encoder for responses of mediaType, which
+// replaces the built-in encoder of a media type. Respond picks the response
+// format among JSON, XML, gob and the registered media types from the
+// request's Accept header, honoring quality values. JSON stays the default,
+// notably for an empty or */* Accept header, and requests accepting none of
+// the formats are answered with 406 Not Acceptable.
+func WithEncoder(mediaType string, fn EncoderFunc) APIOptFn {
+	return func(api *API) {
+		if api.encoders == nil {
+			api.encoders = make(map[string]EncoderFunc)
+		}
+		if _, ok := api.encoders[mediaType]; !ok && !isBuiltinOffer(mediaType) {
+			api.offers = append(api.offers, mediaType)
+		}
+		api.encoders[mediaType] = fn
+	}
+}
+
+// negotiate returns the media type of the response to r, or "" when the
+// request accepts none of the formats.
+func (a *API) negotiate(w http.ResponseWriter, r *http.Request) string {
+	offers := builtinOffers
+	if a != nil && len(a.offers) > 0 {
+		offers = append(append([]string(nil), builtinOffers...), a.offers...)
+	}
+	// the response differs with the request's Accept header.
+	addHeaderOnce(w.Header(), "Vary", "Accept")
+	return Negotiate(r.Header.Get("Accept"), offers)
+}
+
+func isBuiltinOffer(mediaType string) bool {
+	for _, offer := range builtinOffers {
+		if offer == mediaType {
+			return true
+		}
+	}
+	return false
+}
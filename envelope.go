@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+)
+
+type errorsAsDataKey struct{}
+
+// Envelope is the uniform response body written by an API configured with
+// WithEnvelope.
+type Envelope struct {
+	XMLName xml.Name    `json:"-" xml:"response"`
+	Success bool        `json:"success" xml:"success"`
+	Data    interface{} `json:"data,omitempty" xml:"data,omitempty"`
+	Error   interface{} `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// DataError is the body API.Err writes for requests handled with
+// ErrorsAsData.
+type DataError struct {
+	XMLName xml.Name    `json:"-" xml:"response"`
+	OK      bool        `json:"ok" xml:"ok"`
+	Error   interface{} `json:"error" xml:"error"`
+}
+
+// WithErrorsAsData returns a copy of ctx that makes API.Err answer with a 200
+// and the error nested in a DataError, or in an Envelope for APIs configured
+// with WithEnvelope, instead of an HTTP error status.
+func WithErrorsAsData(ctx context.Context) context.Context {
+	return context.WithValue(ctx, errorsAsDataKey{}, true)
+}
+
+// ErrorsAsData returns a middleware that makes API.Err answer requests with
+// a 200 and a {"ok":false,"error":{...}} body instead of mapping the error
+// to an HTTP error status. This contradicts regular REST semantics and is
+// meant for the few endpoints whose clients require it.
+func ErrorsAsData() Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithErrorsAsData(r.Context())))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func errorsAsData(ctx context.Context) bool {
+	ok, _ := ctx.Value(errorsAsDataKey{}).(bool)
+	return ok
+}
@@ -18,7 +18,11 @@ package transport
 
 import (
 	"context"
+	errorsv2 "errors"
+	"fmt"
 	"net/http"
+
+	"github.com/deepauto-io/errors"
 )
 
 // HTTPErrorHandler is a interface for handling http error.
@@ -26,3 +30,51 @@ type HTTPErrorHandler interface {
 	// HandleHTTPError return http handler response.
 	HandleHTTPError(ctx context.Context, err error, w http.ResponseWriter)
 }
+
+// ErrorDetailer is implemented by errors carrying structured details, which
+// are written as the "details" member of the error response body.
+type ErrorDetailer interface {
+	ErrorDetails() interface{}
+}
+
+// errorDetails returns the details of the first ErrorDetailer in err's chain.
+func errorDetails(err error) interface{} {
+	var d ErrorDetailer
+	if errorsv2.As(err, &d) {
+		return d.ErrorDetails()
+	}
+	return nil
+}
+
+// NotFoundError is an errors.ENotFound error about a specific resource.
+// The resource and its ID are included in the error response details so
+// clients can render consistent "X not found" messages.
+type NotFoundError struct {
+	Resource string `json:"resource" xml:"resource"`
+	ID       string `json:"id" xml:"id"`
+}
+
+// NotFound returns an errors.ENotFound error for the resource with the given id.
+func NotFound(resource, id string) error {
+	return &NotFoundError{
+		Resource: resource,
+		ID:       id,
+	}
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %q not found", e.Resource, e.ID)
+}
+
+// Unwrap exposes the platform error, so the error maps to a 404.
+func (e *NotFoundError) Unwrap() error {
+	return &errors.Error{
+		Code: errors.ENotFound,
+		Msg:  e.Error(),
+	}
+}
+
+// ErrorDetails implements ErrorDetailer.
+func (e *NotFoundError) ErrorDetails() interface{} {
+	return e
+}
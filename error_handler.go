@@ -18,6 +18,8 @@ package transport
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"encoding/json"
 	errorsv2 "errors"
@@ -26,6 +28,8 @@ import (
 	"mime"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/deepauto-io/errors"
 	"github.com/deepauto-io/log"
@@ -34,11 +38,28 @@ import (
 // ErrorHandler is a handler for encoding errors to a response.
 type ErrorHandler struct {
 	logger log.Logger
+
+	retryAfter map[string]time.Duration
+}
+
+// ErrorHandlerOptFn is a functional option for setting fields on the ErrorHandler type.
+type ErrorHandlerOptFn func(*ErrorHandler)
+
+// WithErrorHandlerRetryAfter sets the Retry-After duration written for errors
+// of the given codes when the error carries no hint of its own.
+func WithErrorHandlerRetryAfter(defaults map[string]time.Duration) ErrorHandlerOptFn {
+	return func(h *ErrorHandler) {
+		h.retryAfter = defaults
+	}
 }
 
 // NewErrorHandler returns a new ErrorHandler.
-func NewErrorHandler(logger log.Logger) ErrorHandler {
-	return ErrorHandler{logger: logger}
+func NewErrorHandler(logger log.Logger, opts ...ErrorHandlerOptFn) ErrorHandler {
+	h := ErrorHandler{logger: logger}
+	for _, o := range opts {
+		o(&h)
+	}
+	return h
 }
 
 // HandleHTTPError encodes err with the appropriate status code and format,
@@ -50,31 +71,157 @@ func (h ErrorHandler) HandleHTTPError(ctx context.Context, err error, w http.Res
 		return
 	}
 
-	code := errors.ErrorCode(err)
-	var msg string
-	if _, ok := err.(*errors.Error); ok {
-		msg = err.Error()
-	} else {
-		msg = "An internal error has occurred - check server logs"
+	body, status, headers := BuildErrorBody(ctx, err)
+	SetErrorCode(ctx, headers.Get(PlatformErrorCodeHeader))
+	if !isPlatformError(err) {
 		h.logger.Warn("internal error not returned to client: ", err)
 	}
 
-	WriteErrorResponse(ctx, w, code, msg)
+	setRetryAfter(headers, err, h.retryAfter)
+	writeErrorResponse(w, body, status, headers)
 }
 
-func WriteErrorResponse(ctx context.Context, w http.ResponseWriter, code string, msg string) {
-	w.Header().Set(PlatformErrorCodeHeader, code)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(ErrorCodeToStatusCode(ctx, code))
-	e := struct {
-		Code    string `json:"code"`
-		Message string `json:"message"`
-	}{
+// BuildErrorBody returns the body, status code and headers that
+// HandleHTTPError writes for err, without writing them anywhere. It lets
+// the error shaping be reused outside of an http.ResponseWriter, e.g. when
+// embedding the error in a larger response.
+func BuildErrorBody(ctx context.Context, err error) (body []byte, status int, headers http.Header) {
+	if err == nil {
+		return nil, 0, nil
+	}
+
+	code := errorCode(err)
+	msg := "An internal error has occurred - check server logs"
+	if isPlatformError(err) {
+		msg = errorMessage(err)
+	}
+
+	body, status, headers = buildErrorResponse(ctx, ErrBody{
 		Code:    code,
-		Message: msg,
+		Msg:     msg,
+		Details: errorDetails(err),
+	})
+	setRetryAfter(headers, err, nil)
+	return body, status, headers
+}
+
+// WriteErrorResponse writes an error response with the given code and message.
+func WriteErrorResponse(ctx context.Context, w http.ResponseWriter, code string, msg string) {
+	SetErrorCode(ctx, code)
+	body, status, headers := buildErrorResponse(ctx, ErrBody{
+		Code: code,
+		Msg:  msg,
+	})
+	writeErrorResponse(w, body, status, headers)
+}
+
+func buildErrorResponse(ctx context.Context, eb ErrBody) ([]byte, int, http.Header) {
+	headers := http.Header{}
+	headers.Set(PlatformErrorCodeHeader, eb.Code)
+	headers.Set("Content-Type", "application/json; charset=utf-8")
+	if id, ok := RequestIDFromContext(ctx); ok && eb.RequestID == "" {
+		eb.RequestID = id
+	}
+	b, _ := json.Marshal(eb)
+	return b, ErrorCodeToStatusCode(ctx, eb.Code), headers
+}
+
+// writeError writes the response BuildErrorBody builds for err.
+func writeError(ctx context.Context, w http.ResponseWriter, err error) {
+	body, status, headers := BuildErrorBody(ctx, err)
+	SetErrorCode(ctx, headers.Get(PlatformErrorCodeHeader))
+	writeErrorResponse(w, body, status, headers)
+}
+
+func writeErrorResponse(w http.ResponseWriter, body []byte, status int, headers http.Header) {
+	for k, v := range headers {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// isPlatformError reports whether err wraps an *errors.Error.
+func isPlatformError(err error) bool {
+	var perr *errors.Error
+	return errorsv2.As(err, &perr)
+}
+
+// errorCode returns the code of the first *errors.Error with a code in
+// err's tree, so that annotated errors (e.g. WithRetryAfter) keep their code
+// and the errors of errors.Join report the code of the first one that has
+// one. Errors without a code are errors.EInternal.
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	code := errors.EInternal
+	walkErrors(err, func(e error) bool {
+		if perr, ok := e.(*errors.Error); ok && perr != nil && perr.Code != "" {
+			code = perr.Code
+			return false
+		}
+		return true
+	})
+	return code
+}
+
+// errorMessage returns the message of err on a single line. The errors of
+// errors.Join are joined keeping only those wrapping a platform error, whose
+// messages are meant for clients, if there are any.
+func errorMessage(err error) string {
+	msg := err.Error()
+	if !strings.Contains(msg, "\n") {
+		return msg
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		// e.g. a join wrapped with fmt.Errorf.
+		return strings.ReplaceAll(msg, "\n", "; ")
+	}
+
+	var msgs, platformMsgs []string
+	for _, e := range joined.Unwrap() {
+		if e == nil {
+			continue
+		}
+		msgs = append(msgs, errorMessage(e))
+		if isPlatformError(e) {
+			platformMsgs = append(platformMsgs, msgs[len(msgs)-1])
+		}
 	}
-	b, _ := json.Marshal(e)
-	_, _ = w.Write(b)
+	if len(platformMsgs) > 0 {
+		msgs = platformMsgs
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// walkErrors calls fn for err and the errors it wraps, depth first, until fn
+// returns false. Unlike errors.As it descends into the Err of an
+// *errors.Error, which has no Unwrap method. It reports whether the walk
+// completed.
+func walkErrors(err error, fn func(error) bool) bool {
+	if err == nil {
+		return true
+	}
+	if !fn(err) {
+		return false
+	}
+	switch e := err.(type) {
+	case *errors.Error:
+		if e != nil {
+			return walkErrors(e.Err, fn)
+		}
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			if !walkErrors(err, fn) {
+				return false
+			}
+		}
+	case interface{ Unwrap() error }:
+		return walkErrors(e.Unwrap(), fn)
+	}
+	return true
 }
 
 // StatusCodeToErrorCode maps a http status code integer to an
@@ -93,11 +240,12 @@ func StatusCodeToErrorCode(statusCode int) string {
 func ErrorCodeToStatusCode(ctx context.Context, code string) int {
 	// If the client disconnects early or times out then return a different
 	// error than the passed in error code. Client timeouts return a 408
-	// while disconnections return a non-standard Nginx HTTP 499 code.
+	// while disconnections return a non-standard Nginx HTTP 499 code, unless
+	// configured otherwise.
 	if err := ctx.Err(); err == context.DeadlineExceeded {
-		return http.StatusRequestTimeout
+		return int(deadlineExceededStatus.Load())
 	} else if err == context.Canceled {
-		return 499 // https://httpstatuses.com/499
+		return int(canceledStatus.Load())
 	}
 
 	// Otherwise map internal error codes to HTTP status codes.
@@ -108,6 +256,42 @@ func ErrorCodeToStatusCode(ctx context.Context, code string) int {
 	return http.StatusInternalServerError
 }
 
+var (
+	canceledStatus         atomic.Int32
+	deadlineExceededStatus atomic.Int32
+)
+
+func init() {
+	canceledStatus.Store(499) // https://httpstatuses.com/499
+	deadlineExceededStatus.Store(http.StatusRequestTimeout)
+}
+
+// SetCanceledStatusCode sets the status code ErrorCodeToStatusCode returns
+// for requests whose context was canceled, typically because the client
+// disconnected. Defaults to the non-standard 499 of Nginx, which some load
+// balancers reject; 400 is a common standard alternative. Call it during
+// initialization.
+func SetCanceledStatusCode(code int) {
+	canceledStatus.Store(int32(code))
+}
+
+// SetDeadlineExceededStatusCode sets the status code ErrorCodeToStatusCode
+// returns for requests whose context deadline was exceeded. Defaults to 408
+// Request Timeout. Call it during initialization.
+func SetDeadlineExceededStatusCode(code int) {
+	deadlineExceededStatus.Store(int32(code))
+}
+
+// Error codes that are used by this package but are not defined by the
+// errors package.
+const (
+	EUnsupportedMediaType = "unsupported media type"
+	ENotAcceptable        = "not acceptable"
+	ERangeNotSatisfiable  = "range not satisfiable"
+	ERequestTimeout       = "request timeout"
+	EPreconditionFailed   = "precondition failed"
+)
+
 // apiErrorToStatusCode is a mapping of ErrorCode to http status code.
 var apiErrorToStatusCode = map[string]int{
 	errors.EInternal:            http.StatusInternalServerError,
@@ -127,6 +311,11 @@ var apiErrorToStatusCode = map[string]int{
 	errors.EPaymentRequired:     http.StatusPaymentRequired,
 	errors.EUpgradeRequired:     http.StatusUpgradeRequired,
 	errors.EStatusLocked:        http.StatusLocked,
+	EUnsupportedMediaType:       http.StatusUnsupportedMediaType,
+	ENotAcceptable:              http.StatusNotAcceptable,
+	ERangeNotSatisfiable:        http.StatusRequestedRangeNotSatisfiable,
+	ERequestTimeout:             http.StatusRequestTimeout,
+	EPreconditionFailed:         http.StatusPreconditionFailed,
 }
 
 var httpStatusCodeToError = map[int]string{}
@@ -135,12 +324,17 @@ func init() {
 	for k, v := range apiErrorToStatusCode {
 		httpStatusCodeToError[v] = k
 	}
+	// several codes share these statuses, pick one instead of whichever
+	// was iterated last so the reverse mapping is stable.
+	httpStatusCodeToError[http.StatusBadRequest] = errors.EInvalid
+	httpStatusCodeToError[http.StatusUnprocessableEntity] = errors.EUnprocessableEntity
 }
 
 // CheckError reads the http.Response and returns an error if one exists.
 // It will automatically recognize the errors returned by Influx services
 // and decode the error into an internal error type. If the error cannot
 // be determined in that way, it will create a generic error message.
+// A Retry-After header is attached to the error, see RetryAfter.
 //
 // If there is no error, then this returns nil.
 func CheckError(resp *http.Response) (err error) {
@@ -157,15 +351,18 @@ func CheckError(resp *http.Response) (err error) {
 		}
 	}
 
+	// rate limited or unavailable downstreams tell when to retry, keep the
+	// hint for the caller, see RetryAfter.
+	defer func() {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			err = WithRetryAfter(err, d)
+		}
+	}()
+
 	perr := &errors.Error{
 		Code: StatusCodeToErrorCode(resp.StatusCode),
 	}
 
-	if resp.StatusCode == http.StatusUnsupportedMediaType {
-		perr.Msg = fmt.Sprintf("invalid media type: %q", resp.Header.Get("Content-Type"))
-		return perr
-	}
-
 	contentType := resp.Header.Get("Content-Type")
 	if contentType == "" {
 		// Assume JSON if there is no content-type.
@@ -179,6 +376,13 @@ func CheckError(resp *http.Response) (err error) {
 		perr.Err = err
 		return perr
 	}
+	buf = decodeContentEncoding(buf, resp.Header.Get("Content-Encoding"))
+
+	if resp.StatusCode == http.StatusUnsupportedMediaType && buf.Len() == 0 {
+		// servers of this package explain a 415 in the body, others may not.
+		perr.Msg = fmt.Sprintf("invalid media type: %q", resp.Header.Get("Content-Type"))
+		return perr
+	}
 
 	switch mediatype {
 	case "application/json":
@@ -197,6 +401,34 @@ func CheckError(resp *http.Response) (err error) {
 	return perr
 }
 
+// decodeContentEncoding decompresses buf according to the Content-Encoding
+// header, unless http.Transport already did. Bodies that fail to decompress
+// are returned as is.
+func decodeContentEncoding(buf bytes.Buffer, encoding string) bytes.Buffer {
+	var (
+		rc  io.ReadCloser
+		err error
+	)
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		rc, err = gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	case "deflate":
+		rc, err = zlib.NewReader(bytes.NewReader(buf.Bytes()))
+	default:
+		return buf
+	}
+	if err != nil {
+		return buf
+	}
+	defer rc.Close()
+
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, rc); err != nil {
+		return buf
+	}
+	return out
+}
+
 func firstLineAsError(buf bytes.Buffer) error {
 	line, _ := buf.ReadString('\n')
 	return errorsv2.New(strings.TrimSuffix(line, "\n"))
@@ -0,0 +1,161 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	errorsv2 "errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/deepauto-io/errors"
+)
+
+// multiError is a joined error that, unlike errors.Join, keeps nil errors.
+type multiError []error
+
+func (m multiError) Error() string {
+	var msgs []string
+	for _, err := range m {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (m multiError) Unwrap() []error {
+	return m
+}
+
+func TestErrorCodeAndMessage(t *testing.T) {
+	notFound := &errors.Error{Code: errors.ENotFound, Msg: "user not found"}
+	conflict := &errors.Error{Code: errors.EConflict, Msg: "name taken"}
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode string
+		wantMsg  string
+	}{
+		{
+			name:     "platform error",
+			err:      notFound,
+			wantCode: errors.ENotFound,
+			wantMsg:  "user not found",
+		},
+		{
+			name:     "wrapped once",
+			err:      fmt.Errorf("get user: %w", notFound),
+			wantCode: errors.ENotFound,
+			wantMsg:  "get user: user not found",
+		},
+		{
+			name:     "wrapped twice",
+			err:      fmt.Errorf("handler: %w", fmt.Errorf("get user: %w", notFound)),
+			wantCode: errors.ENotFound,
+			wantMsg:  "handler: get user: user not found",
+		},
+		{
+			name:     "platform error wrapping a platform error",
+			err:      &errors.Error{Err: notFound},
+			wantCode: errors.ENotFound,
+			wantMsg:  "user not found",
+		},
+		{
+			name:     "joined",
+			err:      errorsv2.Join(notFound, conflict),
+			wantCode: errors.ENotFound,
+			wantMsg:  "user not found; name taken",
+		},
+		{
+			name:     "joined after a plain error",
+			err:      errorsv2.Join(errorsv2.New("db: connection reset"), fmt.Errorf("get user: %w", notFound)),
+			wantCode: errors.ENotFound,
+			wantMsg:  "get user: user not found",
+		},
+		{
+			name:     "joined after a platform error without code",
+			err:      errorsv2.Join(&errors.Error{Err: errorsv2.New("boom")}, conflict),
+			wantCode: errors.EConflict,
+			wantMsg:  "boom; name taken",
+		},
+		{
+			name:     "wrapped join",
+			err:      fmt.Errorf("batch: %w", errorsv2.Join(errorsv2.New("plain"), conflict)),
+			wantCode: errors.EConflict,
+			wantMsg:  "batch: plain; name taken",
+		},
+		{
+			name:     "nil inside join",
+			err:      multiError{nil, notFound, nil, conflict},
+			wantCode: errors.ENotFound,
+			wantMsg:  "user not found; name taken",
+		},
+		{
+			name:     "errors.Join dropping nil",
+			err:      errorsv2.Join(nil, notFound),
+			wantCode: errors.ENotFound,
+			wantMsg:  "user not found",
+		},
+		{
+			name:     "plain error",
+			err:      errorsv2.New("boom"),
+			wantCode: errors.EInternal,
+			wantMsg:  "An internal error has occurred - check server logs",
+		},
+		{
+			name:     "joined plain errors",
+			err:      multiError{errorsv2.New("a"), nil, errorsv2.New("b")},
+			wantCode: errors.EInternal,
+			wantMsg:  "An internal error has occurred - check server logs",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCode(tt.err); got != tt.wantCode {
+				t.Errorf("errorCode() = %q, want %q", got, tt.wantCode)
+			}
+
+			body, status, headers := BuildErrorBody(context.Background(), tt.err)
+			var eb ErrBody
+			if err := json.Unmarshal(body, &eb); err != nil {
+				t.Fatalf("decoding error body %q: %v", body, err)
+			}
+			if eb.Code != tt.wantCode {
+				t.Errorf("body code = %q, want %q", eb.Code, tt.wantCode)
+			}
+			if eb.Msg != tt.wantMsg {
+				t.Errorf("body message = %q, want %q", eb.Msg, tt.wantMsg)
+			}
+			if got := headers.Get(PlatformErrorCodeHeader); got != tt.wantCode {
+				t.Errorf("%s = %q, want %q", PlatformErrorCodeHeader, got, tt.wantCode)
+			}
+			if want := ErrorCodeToStatusCode(context.Background(), tt.wantCode); status != want {
+				t.Errorf("status = %d, want %d", status, want)
+			}
+		})
+	}
+}
+
+func TestErrorCodeNil(t *testing.T) {
+	if got := errorCode(nil); got != "" {
+		t.Errorf("errorCode(nil) = %q, want empty", got)
+	}
+}
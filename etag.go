@@ -0,0 +1,165 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// ETagStore persists the ETags computed by ETagTrailer so later conditional
+// requests for the same resource can be answered without running the handler.
+type ETagStore interface {
+	// Get returns the ETag stored for key.
+	Get(key string) (etag string, ok bool)
+	// Set stores the ETag for key.
+	Set(key, etag string)
+}
+
+// ETagTrailer returns a middleware computing the ETag of a response
+// incrementally, while the body is being written, and sending it as an HTTP
+// trailer. Unlike an ETag computed from a buffered body it works for large
+// and streamed responses.
+//
+// When store is not nil, the ETags of successful GET responses are stored
+// under the request URI, and GET or HEAD requests whose If-None-Match
+// matches the stored ETag are answered with 304 Not Modified straight away.
+// Requests with other methods whose If-Match does not match the stored ETag
+// are rejected with an EPreconditionFailed error (412), preventing lost
+// updates. If-None-Match uses the weak and If-Match the strong comparison.
+//
+// HEAD responses get no trailer, only the stored ETag, if any, as a header.
+func ETagTrailer(store ETagStore) Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			key := r.URL.RequestURI()
+			cacheable := r.Method == http.MethodGet || r.Method == http.MethodHead
+			if store != nil && cacheable {
+				if etag, ok := store.Get(key); ok && etagMatch(r.Header.Get("If-None-Match"), etag, false) {
+					w.Header().Set("ETag", etag)
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			if ifMatch := r.Header.Get("If-Match"); store != nil && !cacheable && ifMatch != "" {
+				if etag, ok := store.Get(key); ok && !etagMatch(ifMatch, etag, true) {
+					WriteErrorResponse(r.Context(), w, EPreconditionFailed, "resource has been modified, If-Match does not match")
+					return
+				}
+			}
+
+			if r.Method == http.MethodHead {
+				// the empty body of a HEAD response has an ETag of its own,
+				// which would not match the GET response's.
+				if store != nil {
+					if etag, ok := store.Get(key); ok {
+						w.Header().Set("ETag", etag)
+					}
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Trailer", "ETag")
+			srw := NewStatusResponseWriter(w)
+			srw.hash = sha1.New()
+			next.ServeHTTP(srw, r)
+
+			etag := srw.ETag()
+			w.Header().Set("ETag", etag)
+			if store != nil && r.Method == http.MethodGet && srw.Code()/100 == 2 {
+				store.Set(key, etag)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// formatETag formats a digest as a strong entity tag.
+func formatETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// etagMatch reports whether the If-Match or If-None-Match header value
+// matches etag (RFC 7232, section 2.3.2). The strong comparison, used for
+// If-Match, requires both tags to be strong and identical, while the weak
+// comparison, used for If-None-Match, ignores weakness indicators. "*"
+// matches any current entity.
+func etagMatch(header, etag string, strong bool) bool {
+	header = strings.TrimSpace(header)
+	if header == "" || etag == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+
+	weak, opaque, ok := parseETag(etag)
+	if !ok || (strong && weak) {
+		return false
+	}
+	for _, candidate := range parseETagList(header) {
+		if candidate.opaque == opaque && (!strong || !candidate.weak) {
+			return true
+		}
+	}
+	return false
+}
+
+type entityTag struct {
+	weak   bool
+	opaque string
+}
+
+// parseETag parses a single entity tag, e.g. `W/"abc"`.
+func parseETag(s string) (weak bool, opaque string, ok bool) {
+	tags := parseETagList(s)
+	if len(tags) != 1 {
+		return false, "", false
+	}
+	return tags[0].weak, tags[0].opaque, true
+}
+
+// parseETagList parses a comma separated list of entity tags. Opaque tags
+// are quoted and may contain commas. Parsing stops at the first malformed
+// tag.
+func parseETagList(s string) []entityTag {
+	var tags []entityTag
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return tags
+		}
+		var tag entityTag
+		if strings.HasPrefix(s, "W/") {
+			tag.weak = true
+			s = s[2:]
+		}
+		if !strings.HasPrefix(s, `"`) {
+			return tags
+		}
+		end := strings.IndexByte(s[1:], '"')
+		if end < 0 {
+			return tags
+		}
+		tag.opaque = s[1 : end+1]
+		tags = append(tags, tag)
+		s = s[end+2:]
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import "testing"
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		strong bool
+		want   bool
+	}{
+		{name: "identical strong tags", header: `"a"`, etag: `"a"`, strong: true, want: true},
+		{name: "identical strong tags weakly", header: `"a"`, etag: `"a"`, want: true},
+		{name: "weak header strongly", header: `W/"a"`, etag: `"a"`, strong: true, want: false},
+		{name: "weak header weakly", header: `W/"a"`, etag: `"a"`, want: true},
+		{name: "weak etag strongly", header: `"a"`, etag: `W/"a"`, strong: true, want: false},
+		{name: "weak etag weakly", header: `"a"`, etag: `W/"a"`, want: true},
+		{name: "both weak weakly", header: `W/"a"`, etag: `W/"a"`, want: true},
+		{name: "different tags", header: `"b"`, etag: `"a"`, want: false},
+		{name: "wildcard strongly", header: `*`, etag: `"a"`, strong: true, want: true},
+		{name: "wildcard weakly", header: ` * `, etag: `W/"a"`, want: true},
+		{name: "list", header: `"x","a"`, etag: `"a"`, strong: true, want: true},
+		{name: "list with spaces", header: ` "x" ,  W/"y" , "a" `, etag: `"a"`, strong: true, want: true},
+		{name: "list with weak match strongly", header: `"x", W/"a"`, etag: `"a"`, strong: true, want: false},
+		{name: "list with weak match weakly", header: `"x", W/"a"`, etag: `"a"`, want: true},
+		{name: "tag containing a comma", header: `"a,b"`, etag: `"a,b"`, strong: true, want: true},
+		{name: "comma tag is not split", header: `"a,b"`, etag: `"a"`, want: false},
+		{name: "list of comma tags", header: `"x,y", "a,b"`, etag: `"a,b"`, want: true},
+		{name: "unquoted header", header: `a`, etag: `"a"`, want: false},
+		{name: "unterminated header", header: `"a`, etag: `"a"`, want: false},
+		{name: "malformed entry stops parsing", header: `bogus, "a"`, etag: `"a"`, want: false},
+		{name: "match before malformed entry", header: `"a", bogus`, etag: `"a"`, want: true},
+		{name: "malformed etag", header: `"a"`, etag: `a`, want: false},
+		{name: "empty header", header: ``, etag: `"a"`, want: false},
+		{name: "blank header", header: ` `, etag: `"a"`, want: false},
+		{name: "empty etag", header: `"a"`, etag: ``, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatch(tt.header, tt.etag, tt.strong); got != tt.want {
+				t.Errorf("etagMatch(%q, %q, %v) = %v, want %v", tt.header, tt.etag, tt.strong, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseETagList(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []entityTag
+	}{
+		{name: "empty", header: ``, want: nil},
+		{name: "single", header: `"a"`, want: []entityTag{{opaque: "a"}}},
+		{name: "weak", header: `W/"a"`, want: []entityTag{{weak: true, opaque: "a"}}},
+		{
+			name:   "list with spaces and tabs",
+			header: " \"a\" ,\tW/\"b\" ,, \"c\"",
+			want:   []entityTag{{opaque: "a"}, {weak: true, opaque: "b"}, {opaque: "c"}},
+		},
+		{name: "quoted comma", header: `"a,b", "c"`, want: []entityTag{{opaque: "a,b"}, {opaque: "c"}}},
+		{name: "empty opaque tag", header: `""`, want: []entityTag{{opaque: ""}}},
+		{name: "malformed", header: `abc`, want: nil},
+		{name: "unterminated", header: `"a", "b`, want: []entityTag{{opaque: "a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseETagList(tt.header)
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseETagList(%q) = %+v, want %+v", tt.header, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("parseETagList(%q)[%d] = %+v, want %+v", tt.header, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
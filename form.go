@@ -0,0 +1,217 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formMediaType      = "application/x-www-form-urlencoded"
+	multipartMediaType = "multipart/form-data"
+
+	// defaultMaxFormMemory is how much of a multipart form is kept in memory,
+	// the remaining files are stored on disk.
+	defaultMaxFormMemory = 32 << 20
+)
+
+var (
+	fileHeaderType  = reflect.TypeOf((*multipart.FileHeader)(nil))
+	fileHeadersType = reflect.TypeOf([]*multipart.FileHeader(nil))
+	durationType    = reflect.TypeOf(time.Duration(0))
+)
+
+// DecodeForm decodes the URL-encoded or multipart form of r, including its
+// query parameters, into the struct v points to. Fields are matched by their
+// "form" tag, or their name without one, and may be strings, bools, numbers,
+// time.Duration, encoding.TextUnmarshaler implementations, pointers or
+// slices of those. Uploaded files of a multipart form are set on
+// *multipart.FileHeader and []*multipart.FileHeader fields. The result is
+// validated like every decoded body.
+func (a *API) DecodeForm(r *http.Request, v interface{}) error {
+	if a != nil && a.maxBodyBytes > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(nil, r.Body, a.maxBodyBytes)
+	}
+	return a.decode("form", &formDecoder{r: r}, v)
+}
+
+// formDecoder decodes the form of a request.
+type formDecoder struct {
+	r *http.Request
+}
+
+func (d *formDecoder) Decode(v interface{}) error {
+	var files map[string][]*multipart.FileHeader
+	mediaType, _, _ := mime.ParseMediaType(d.r.Header.Get("Content-Type"))
+	if mediaType == multipartMediaType {
+		if err := d.r.ParseMultipartForm(defaultMaxFormMemory); err != nil {
+			return err
+		}
+		files = d.r.MultipartForm.File
+	} else if err := d.r.ParseForm(); err != nil {
+		return err
+	}
+	return decodeFormValues(d.r.Form, files, v)
+}
+
+// urlEncodedDecoder decodes a URL-encoded form read from r.
+type urlEncodedDecoder struct {
+	r io.Reader
+}
+
+func (d *urlEncodedDecoder) Decode(v interface{}) error {
+	b, err := io.ReadAll(d.r)
+	if err != nil {
+		return err
+	}
+	values, err := url.ParseQuery(string(b))
+	if err != nil {
+		return err
+	}
+	return decodeFormValues(values, nil, v)
+}
+
+func decodeFormValues(values url.Values, files map[string][]*multipart.FileHeader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot decode form into %T, need a pointer to a struct", v)
+	}
+	return setFormFields(rv.Elem(), values, files)
+}
+
+func setFormFields(sv reflect.Value, values url.Values, files map[string][]*multipart.FileHeader) error {
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		fv := sv.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("form"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && fv.Kind() == reflect.Struct {
+			if err := setFormFields(fv, values, files); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		switch fv.Type() {
+		case fileHeaderType:
+			if fhs := files[name]; len(fhs) > 0 {
+				fv.Set(reflect.ValueOf(fhs[0]))
+			}
+			continue
+		case fileHeadersType:
+			if fhs := files[name]; len(fhs) > 0 {
+				fv.Set(reflect.ValueOf(fhs))
+			}
+			continue
+		}
+
+		vals := values[name]
+		if len(vals) == 0 {
+			continue
+		}
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+			s := reflect.MakeSlice(fv.Type(), len(vals), len(vals))
+			for j, val := range vals {
+				if err := setFormValue(s.Index(j), val); err != nil {
+					return fmt.Errorf("field %q: %w", name, err)
+				}
+			}
+			fv.Set(s)
+			continue
+		}
+		if err := setFormValue(fv, vals[0]); err != nil {
+			return fmt.Errorf("field %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setFormValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr {
+		p := reflect.New(v.Type().Elem())
+		if err := setFormValue(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+	if tu, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return tu.UnmarshalText([]byte(s))
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		// []byte
+		v.SetBytes([]byte(s))
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
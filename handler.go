@@ -1,11 +1,78 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
 package transport
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+)
+
+// ErrHandlerFunc is an http handler returning an error instead of writing it.
+type ErrHandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// Handler adapts fn to an http.Handler writing the errors fn returns with
+// Err. fn must not write the response when it returns an error.
+func (a *API) Handler(fn ErrHandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := fn(w, r); err != nil {
+			a.Err(w, r, err)
+		}
+	})
+}
+
+type handleOpts struct {
+	status int
+}
+
+// HandleOptFn is a functional option for Handle.
+type HandleOptFn func(*handleOpts)
+
+// WithSuccessStatus sets the status Handle responds with on success.
+// Defaults to 200 OK.
+func WithSuccessStatus(status int) HandleOptFn {
+	return func(o *handleOpts) {
+		o.status = status
+	}
+}
+
+// Handle adapts fn to an http.Handler. The request body is decoded into a
+// Req with DecodeRequest, validated like every decoded body, and passed to
+// fn. The Resp fn returns is written with Respond, its error with Err.
+// Requests without a body, e.g. GET requests, are passed a zero Req.
+func Handle[Req, Resp any](a *API, fn func(ctx context.Context, req *Req) (Resp, error), opts ...HandleOptFn) http.Handler {
+	o := handleOpts{status: http.StatusOK}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		if r.Body != nil && r.Body != http.NoBody {
+			if err := a.DecodeRequest(r, &req); err != nil {
+				a.Err(w, r, err)
+				return
+			}
+		}
 
-// ResourceHandler is an HTTP handler for a resource. The prefix
-// describes the url path prefix that relates to the handler
-// endpoints.
-type ResourceHandler interface {
-	Prefix() string
-	http.Handler
+		resp, err := fn(r.Context(), &req)
+		if err != nil {
+			a.Err(w, r, err)
+			return
+		}
+		a.Respond(w, r, o.status, resp)
+	})
 }
@@ -0,0 +1,103 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/deepauto-io/errors"
+)
+
+// HealthCheck is a named check of a dependency, e.g. a database ping, run
+// by HealthHandler.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// healthStatusOK is the status of a passing check.
+const healthStatusOK = "ok"
+
+// HealthError is the errors.EUnavailable error of a failing HealthHandler.
+// Its details map the name of every check to "ok" or its error message.
+type HealthError struct {
+	Checks map[string]string
+}
+
+func (e *HealthError) Error() string {
+	return "health check failed"
+}
+
+// Unwrap exposes the platform error, so the error maps to a 503.
+func (e *HealthError) Unwrap() error {
+	return &errors.Error{
+		Code: errors.EUnavailable,
+		Msg:  e.Error(),
+	}
+}
+
+// ErrorDetails implements ErrorDetailer.
+func (e *HealthError) ErrorDetails() interface{} {
+	return e.Checks
+}
+
+// HealthHandler returns a handler for health and readiness endpoints such as
+// /healthz. It runs the checks concurrently and responds 200 OK with the
+// status of every check when all pass, or an errors.EUnavailable error with
+// the status of every check as details when any fails. Responses are
+// written with Respond and Err, so they follow the API's encoding.
+func (a *API) HealthHandler(checks ...HealthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		statuses := make(map[string]string, len(checks))
+		var (
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+			failed bool
+		)
+		for _, check := range checks {
+			wg.Add(1)
+			go func(check HealthCheck) {
+				defer wg.Done()
+				status := healthStatusOK
+				if err := check.Check(r.Context()); err != nil {
+					status = err.Error()
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				statuses[check.Name] = status
+				if status != healthStatusOK {
+					failed = true
+				}
+			}(check)
+		}
+		wg.Wait()
+
+		if failed {
+			a.Err(w, r, &HealthError{Checks: statuses})
+			return
+		}
+		a.Respond(w, r, http.StatusOK, map[string]interface{}{
+			"status": healthStatusOK,
+			"checks": statuses,
+		})
+	})
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/deepauto-io/errors"
+)
+
+// IdempotencyKeyHeader is the default header carrying idempotency keys.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyKeyOptions configures RequireIdempotencyKey.
+type IdempotencyKeyOptions struct {
+	// Header is the header carrying the key. Defaults to Idempotency-Key.
+	Header string
+	// Reject answers requests without a key with an errors.EInvalid error.
+	// Otherwise they are served with a Warning header, which lets clients
+	// be migrated before the contract is enforced.
+	Reject bool
+}
+
+// RequireIdempotencyKey returns a middleware enforcing that POST and PATCH
+// requests, which are not idempotent, carry an idempotency key. Without a
+// key the server cannot tell a retry from a new request, so retrying such a
+// request, e.g. after a timeout, may apply it twice.
+func RequireIdempotencyKey(opts IdempotencyKeyOptions) Middleware {
+	header := opts.Header
+	if header == "" {
+		header = IdempotencyKeyHeader
+	}
+	msg := fmt.Sprintf("POST and PATCH requests must carry a unique %s header so they can be retried safely", header)
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			unsafe := r.Method == http.MethodPost || r.Method == http.MethodPatch
+			if !unsafe || r.Header.Get(header) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if opts.Reject {
+				writeError(r.Context(), w, &errors.Error{
+					Code: errors.EInvalid,
+					Msg:  msg,
+				})
+				return
+			}
+			addHeaderOnce(w.Header(), "Warning", `299 - "`+quotedStringEscaper.Replace(msg)+`"`)
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
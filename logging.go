@@ -0,0 +1,316 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepauto-io/log"
+)
+
+// LoggingOptFn is a functional option for LoggingMW.
+type LoggingOptFn func(*loggingOpts)
+
+type loggingOpts struct {
+	slowErrorThreshold time.Duration
+	slowThreshold      time.Duration
+	errorReporter      func(r *http.Request, status int, took time.Duration)
+	bodySnippetBytes   int
+	headerSizes        bool
+	pathNormalizer     func(r *http.Request) string
+	classLevels        map[int]log.Level
+	sampleEvery        uint64
+	sampleCount        atomic.Uint64
+	redactedQuery      map[string]bool
+	redactedHeaders    map[string]bool
+	trustedProxies     *TrustedProxies
+}
+
+// WithSlowErrorEscalation logs requests that were answered with a 5xx status
+// and took longer than threshold at Error level. A fast 5xx is often a
+// validation edge case, while a slow one usually points at a failing
+// dependency, so the combination deserves a louder signal.
+func WithSlowErrorEscalation(threshold time.Duration) LoggingOptFn {
+	return func(o *loggingOpts) {
+		o.slowErrorThreshold = threshold
+	}
+}
+
+// WithSlowThreshold logs requests that took longer than threshold at Warn
+// level, or higher when their status calls for it, with a slow=true field,
+// to spot latency regressions from the logs alone.
+func WithSlowThreshold(threshold time.Duration) LoggingOptFn {
+	return func(o *loggingOpts) {
+		o.slowThreshold = threshold
+	}
+}
+
+// slow reports whether a request that took took exceeded the slow threshold.
+func (o *loggingOpts) slow(took time.Duration) bool {
+	return o.slowThreshold > 0 && took > o.slowThreshold
+}
+
+// WithTrustedProxies logs the client IP as found by t.ClientIP in the
+// remote field, walking the X-Forwarded-For list of trusted proxies. By
+// default the remote field is ClientIP(r, nil), i.e. X-Real-IP or the peer
+// address.
+func WithTrustedProxies(t *TrustedProxies) LoggingOptFn {
+	return func(o *loggingOpts) {
+		o.trustedProxies = t
+	}
+}
+
+// WithErrorReporter sets a function that is called for every request whose
+// log entry was escalated to Error level, e.g. to notify an error tracker.
+func WithErrorReporter(fn func(r *http.Request, status int, took time.Duration)) LoggingOptFn {
+	return func(o *loggingOpts) {
+		o.errorReporter = fn
+	}
+}
+
+// WithResponseBodySnippet logs up to n bytes of each response body in the
+// response_body field. The snippet is taken as written, so compressed
+// responses are logged compressed.
+func WithResponseBodySnippet(n int) LoggingOptFn {
+	return func(o *loggingOpts) {
+		o.bodySnippetBytes = n
+	}
+}
+
+// WithHeaderSizes logs the number and total size of the request and
+// response headers, to spot header bloat such as an ever growing cookie
+// before it hits proxy limits.
+func WithHeaderSizes() LoggingOptFn {
+	return func(o *loggingOpts) {
+		o.headerSizes = true
+	}
+}
+
+// headerSize returns the number of values in h and the sum of the lengths
+// of their keys and values.
+func headerSize(h http.Header) (count, size int) {
+	for k, vs := range h {
+		for _, v := range vs {
+			count++
+			size += len(k) + len(v)
+		}
+	}
+	return count, size
+}
+
+// WithStatusClassLevel sets the level requests answered with a status of
+// the given class, e.g. 2 for 2xx, are logged at. Classes without a level
+// are logged at Info.
+func WithStatusClassLevel(class int, level log.Level) LoggingOptFn {
+	return func(o *loggingOpts) {
+		if o.classLevels == nil {
+			o.classLevels = make(map[int]log.Level)
+		}
+		o.classLevels[class] = level
+	}
+}
+
+// WithSuccessSampling logs only a fraction rate, between 0 and 1, of the
+// requests answered with a status below 400, while always logging client
+// and server errors. Sampling is deterministic: with a rate of 0.1 every
+// tenth successful request is logged.
+func WithSuccessSampling(rate float64) LoggingOptFn {
+	return func(o *loggingOpts) {
+		o.sampleEvery = 0
+		if rate > 0 && rate < 1 {
+			o.sampleEvery = uint64(math.Round(1 / rate))
+		} else if rate <= 0 {
+			o.sampleEvery = math.MaxUint64
+		}
+	}
+}
+
+// sampled reports whether a request answered with status is logged.
+func (o *loggingOpts) sampled(status int) bool {
+	if o.sampleEvery <= 1 || status >= http.StatusBadRequest {
+		return true
+	}
+	if o.sampleEvery == math.MaxUint64 {
+		return false
+	}
+	return (o.sampleCount.Add(1)-1)%o.sampleEvery == 0
+}
+
+// WithPathNormalizer sets a function returning the path logged for a
+// request, e.g. its route pattern or NormalizePathIDs of its path, so paths
+// embedding IDs do not explode the cardinality of the path field.
+func WithPathNormalizer(fn func(r *http.Request) string) LoggingOptFn {
+	return func(o *loggingOpts) {
+		o.pathNormalizer = fn
+	}
+}
+
+// NormalizePathIDs replaces the path segments that look like IDs, i.e.
+// numbers, UUIDs and long hexadecimal strings, with "{id}":
+// "/users/12345/orders/98" becomes "/users/{id}/orders/{id}".
+func NormalizePathIDs(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if looksLikeID(seg) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func looksLikeID(seg string) bool {
+	if seg == "" {
+		return false
+	}
+	digits := true
+	for i := 0; i < len(seg); i++ {
+		c := seg[i]
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F', c == '-':
+			digits = false
+		default:
+			return false
+		}
+	}
+	// UUIDs and hashes, but not short words made of hex letters like "beef".
+	return digits || len(seg) >= 16
+}
+
+// path returns the path logged for r.
+func (o *loggingOpts) path(r *http.Request) string {
+	if o.pathNormalizer != nil {
+		return o.pathNormalizer(r)
+	}
+	return logPath(r)
+}
+
+// errorCodeHolder lets handlers report the error code of their response to
+// LoggingMW, which cannot see their request context.
+type errorCodeHolder struct {
+	code string
+}
+
+type errorCodeKey struct{}
+
+func withErrorCodeHolder(ctx context.Context) (context.Context, *errorCodeHolder) {
+	if h, ok := ctx.Value(errorCodeKey{}).(*errorCodeHolder); ok {
+		return ctx, h
+	}
+	h := &errorCodeHolder{}
+	return context.WithValue(ctx, errorCodeKey{}, h), h
+}
+
+// SetErrorCode reports the error code the request of ctx is answered with,
+// so LoggingMW logs it as the error reference even when the response does
+// not carry the X-Platform-Error-Code header. Err, HandleHTTPError and
+// WriteErrorResponse call it; handlers writing errors their own way should
+// too. It has no effect outside of LoggingMW.
+func SetErrorCode(ctx context.Context, code string) {
+	if h, ok := ctx.Value(errorCodeKey{}).(*errorCodeHolder); ok {
+		h.code = code
+	}
+}
+
+// level returns the level a request is logged at.
+func (o *loggingOpts) level(status int, took time.Duration) log.Level {
+	if o.slowErrorThreshold > 0 && status >= http.StatusInternalServerError && took > o.slowErrorThreshold {
+		return log.ErrorLevel
+	}
+	level := log.InfoLevel
+	if l, ok := o.classLevels[status/100]; ok {
+		level = l
+	}
+	if o.slow(took) && level > log.WarnLevel {
+		level = log.WarnLevel
+	}
+	return level
+}
+
+// logAt logs args with logger at the given level.
+func logAt(logger log.Logger, level log.Level, args ...interface{}) {
+	switch level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		logger.Error(args...)
+	case log.WarnLevel:
+		logger.Warn(args...)
+	case log.InfoLevel:
+		logger.Info(args...)
+	default:
+		logger.Debug(args...)
+	}
+}
+
+// redacted replaces the values of redacted query parameters and headers.
+const redacted = "***"
+
+// WithRedactedQueryParams replaces the values of the named query parameters
+// with "***" in the logged query, so secrets passed in the URL, such as
+// access tokens or signatures, do not end up in the logs. Names are case
+// sensitive, like query parameters.
+func WithRedactedQueryParams(names ...string) LoggingOptFn {
+	return func(o *loggingOpts) {
+		if o.redactedQuery == nil {
+			o.redactedQuery = make(map[string]bool)
+		}
+		for _, name := range names {
+			o.redactedQuery[name] = true
+		}
+	}
+}
+
+// WithRedactedHeaders replaces the values of the named headers with "***"
+// in every logged field derived from a header, i.e. the referrer, user agent
+// and forwarded remote address. Headers such as Authorization are never
+// logged, but redacting them as well keeps them out of fields added later.
+func WithRedactedHeaders(names ...string) LoggingOptFn {
+	return func(o *loggingOpts) {
+		if o.redactedHeaders == nil {
+			o.redactedHeaders = make(map[string]bool)
+		}
+		for _, name := range names {
+			o.redactedHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+}
+
+// query returns the encoded query of r with the redacted parameters masked.
+func (o *loggingOpts) query(r *http.Request) string {
+	q := r.URL.Query()
+	for name, vs := range q {
+		if o.redactedQuery[name] {
+			for i := range vs {
+				vs[i] = redacted
+			}
+		}
+	}
+	return q.Encode()
+}
+
+// header returns value, derived from the header name of r, or "***" when
+// the header is set and redacted.
+func (o *loggingOpts) header(r *http.Request, name, value string) string {
+	if o.redactedHeaders[name] && r.Header.Get(name) != "" {
+		return redacted
+	}
+	return value
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// MetricsCollector receives an observation for every request served by
+// Metrics. Implementations must be safe for concurrent use. For example, a
+// Prometheus collector would observe a histogram and a counter vector
+// labeled by method, path and status:
+//
+//	func (c *promCollector) ObserveRequest(method, path string, status int, took time.Duration, responseBytes int) {
+//		code := strconv.Itoa(status)
+//		c.duration.WithLabelValues(method, path, code).Observe(took.Seconds())
+//		c.size.WithLabelValues(method, path, code).Observe(float64(responseBytes))
+//	}
+type MetricsCollector interface {
+	// ObserveRequest records a served request. path is the route template,
+	// e.g. "/users/{id}", when the router reported one with SetRoute.
+	ObserveRequest(method, path string, status int, took time.Duration, responseBytes int)
+}
+
+// NopMetricsCollector is a MetricsCollector discarding every observation.
+type NopMetricsCollector struct{}
+
+// ObserveRequest implements MetricsCollector.
+func (NopMetricsCollector) ObserveRequest(string, string, int, time.Duration, int) {}
+
+// routeHolder lets inner handlers report the matched route to outer
+// middlewares, which cannot see their request context.
+type routeHolder struct {
+	route string
+}
+
+type routeKey struct{}
+
+// withRouteHolder returns a copy of ctx carrying a route holder, reusing an
+// existing one so every middleware sees the same route.
+func withRouteHolder(ctx context.Context) (context.Context, *routeHolder) {
+	if h, ok := ctx.Value(routeKey{}).(*routeHolder); ok {
+		return ctx, h
+	}
+	h := &routeHolder{}
+	return context.WithValue(ctx, routeKey{}, h), h
+}
+
+// SetRoute reports the route template matched for the request of ctx, e.g.
+// from the router, so Metrics labels the request with it rather than the
+// raw, high cardinality path. It has no effect outside of Metrics.
+func SetRoute(ctx context.Context, route string) {
+	if h, ok := ctx.Value(routeKey{}).(*routeHolder); ok {
+		h.route = route
+	}
+}
+
+// Route returns the route template reported with SetRoute, if any.
+func Route(ctx context.Context) (string, bool) {
+	h, ok := ctx.Value(routeKey{}).(*routeHolder)
+	if !ok || h.route == "" {
+		return "", false
+	}
+	return h.route, true
+}
+
+// Metrics returns a middleware reporting the method, route, status, duration
+// and response size of every request to collector. Without a route reported
+// with SetRoute the request path is used.
+func Metrics(collector MetricsCollector) Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx, holder := withRouteHolder(r.Context())
+			ctx, _ = withLogPathHolder(ctx)
+			r = r.WithContext(ctx)
+			srw := NewStatusResponseWriter(w)
+
+			defer func(start time.Time) {
+				path := holder.route
+				if path == "" {
+					path = logPath(r)
+				}
+				collector.ObserveRequest(r.Method, path, srw.Code(), time.Since(start), srw.ResponseBytes())
+			}(time.Now())
+			next.ServeHTTP(srw, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -18,6 +18,7 @@ package transport
 
 import (
 	"bytes"
+	"context"
 	"github.com/deepauto-io/log"
 	ua "github.com/mileusna/useragent"
 	"io"
@@ -28,26 +29,16 @@ import (
 // Middleware constructor.
 type Middleware func(http.Handler) http.Handler
 
+// SetCORS reflects the request Origin back in Access-Control-Allow-Origin
+// and answers every OPTIONS request with 204 No Content. It allows any
+// origin; use CORS with an allowlist of origins instead.
 func SetCORS(next http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		if origin := r.Header.Get("Origin"); origin != "" {
-			// Access-Control-Allow-Origin must be present in every response
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		}
-		if r.Method == http.MethodOptions {
-			// allow and stop processing in pre-flight requests
-			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, PATCH")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, User-Agent")
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		next.ServeHTTP(w, r)
-	}
-	return http.HandlerFunc(fn)
+	return CORS(CORSOptions{AllowedOrigins: []string{"*"}})(next)
 }
 
 // SkipOptions Preflight CORS requests from the browser will send an options request,
-// so we need to make sure we satisfy them
+// so we need to make sure we satisfy them. OPTIONS requests without an Origin
+// are answered with 405; see CORS for choosing this behavior explicitly.
 func SkipOptions(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		// Preflight CORS requests from the browser will send an options request,
@@ -84,10 +75,22 @@ func (b *bodyEchoer) Close() error {
 }
 
 // LoggingMW middleware for logging inflight http requests.
-func LoggingMW(logger log.Logger) Middleware {
+func LoggingMW(logger log.Logger, opts ...LoggingOptFn) Middleware {
+	var o loggingOpts
+	for _, fn := range opts {
+		fn(&o)
+	}
+
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx, errCode := withErrorCodeHolder(r.Context())
+			ctx, _ = withLogPathHolder(ctx)
+			ctx, reqID := withRequestIDHolder(ctx)
+			r = r.WithContext(ctx)
 			srw := NewStatusResponseWriter(w)
+			if o.bodySnippetBytes > 0 {
+				srw = NewStatusResponseWriterWithCapture(w, o.bodySnippetBytes)
+			}
 			var buf bytes.Buffer
 			r.Body = &bodyEchoer{
 				rc:    r.Body,
@@ -95,30 +98,77 @@ func LoggingMW(logger log.Logger) Middleware {
 			}
 
 			defer func(start time.Time) {
-				errReferenceField := ""
-				if errReference := w.Header().Get(PlatformErrorCodeHeader); errReference != "" {
-					errReferenceField = errReference
+				errReferenceField := errCode.code
+				if errReferenceField == "" {
+					errReferenceField = w.Header().Get(PlatformErrorCodeHeader)
 				}
 
-				ip := r.Header.Get("X-Forwarded-For")
-				if ip == "" {
-					ip = r.RemoteAddr
+				// When wrapped by http.TimeoutHandler the handler may never write
+				// after the deadline, so fall back to the request context to spot
+				// a response the timeout handler wrote on our behalf.
+				timedOut := srw.TimedOut() || r.Context().Err() == context.DeadlineExceeded
+				statusCode := srw.Code()
+				if timedOut && srw.statusCode == 0 {
+					statusCode = http.StatusServiceUnavailable
 				}
 
-				logger.WithField("method", r.Method).
+				ip := ClientIP(r, nil)
+				if o.trustedProxies != nil {
+					ip = o.trustedProxies.ClientIP(r)
+				}
+				if ip != remoteHost(r) {
+					// the address was taken from a header.
+					ip = o.header(r, "X-Forwarded-For", o.header(r, "X-Real-IP", ip))
+				}
+
+				// RequestID usually runs inside LoggingMW, so its context is not
+				// visible here; the holder it fills is.
+				requestID, ok := RequestIDFromContext(r.Context())
+				if !ok {
+					requestID = reqID.id
+				}
+
+				if !o.sampled(statusCode) {
+					return
+				}
+
+				took := time.Since(start)
+				level := o.level(statusCode, took)
+
+				entry := logger.WithField("method", r.Method).
 					WithField("host", r.Host).
-					WithField("path", r.URL.Path).
-					WithField("query", r.URL.Query().Encode()).
+					WithField("path", o.path(r)).
+					WithField("query", o.query(r)).
 					WithField("proto", r.Proto).
-					WithField("status_code", srw.Code()).
+					WithField("status_code", statusCode).
 					WithField("response_size", srw.ResponseBytes()).
 					WithField("content_length", r.ContentLength).
-					WithField("referrer", r.Referer()).
+					WithField("referrer", o.header(r, "Referer", r.Referer())).
 					WithField("remote", ip).
-					WithField("user_agent", UserAgent(r)).
-					WithField("took", time.Since(start)).
+					WithField("user_agent", o.header(r, "User-Agent", UserAgent(r))).
+					WithField("took", took).
 					WithField("errReference", errReferenceField).
-					Info("request")
+					WithField("request_id", requestID).
+					WithField("timeout", timedOut)
+				if o.slow(took) {
+					entry = entry.WithField("slow", true)
+				}
+				if o.headerSizes {
+					reqCount, reqSize := headerSize(r.Header)
+					respCount, respSize := headerSize(w.Header())
+					entry = entry.WithField("request_header_count", reqCount).
+						WithField("request_header_size", reqSize).
+						WithField("response_header_count", respCount).
+						WithField("response_header_size", respSize)
+				}
+				if o.bodySnippetBytes > 0 {
+					entry = entry.WithField("response_body", string(srw.Body()))
+				}
+				logAt(entry, level, "request")
+
+				if level == log.ErrorLevel && o.errorReporter != nil {
+					o.errorReporter(r, statusCode, took)
+				}
 			}(time.Now())
 			next.ServeHTTP(srw, r)
 		}
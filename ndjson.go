@@ -0,0 +1,158 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"encoding/json"
+	errorsv2 "errors"
+	"io"
+	"net/http"
+)
+
+// NDJSONMediaType is the media type of newline delimited JSON.
+const NDJSONMediaType = "application/x-ndjson"
+
+// defaultNDJSONFlushEvery is how many records an NDJSONWriter buffers by default.
+const defaultNDJSONFlushEvery = 100
+
+type ndjsonOpts struct {
+	flushEvery int
+	skipErrors bool
+}
+
+// NDJSONOptFn is a functional option for NewNDJSON.
+type NDJSONOptFn func(*ndjsonOpts)
+
+// WithNDJSONFlushEvery flushes the response every n records, so clients
+// receive the stream progressively. Defaults to 100.
+func WithNDJSONFlushEvery(n int) NDJSONOptFn {
+	return func(o *ndjsonOpts) {
+		o.flushEvery = n
+	}
+}
+
+// WithNDJSONSkipErrors logs and skips records that fail to encode instead
+// of aborting the stream.
+func WithNDJSONSkipErrors() NDJSONOptFn {
+	return func(o *ndjsonOpts) {
+		o.skipErrors = true
+	}
+}
+
+// NDJSONWriter streams records as newline delimited JSON, one JSON value
+// per line. Create it with NewNDJSON and Close it when done.
+type NDJSONWriter struct {
+	a    *API
+	w    http.ResponseWriter
+	r    *http.Request
+	wc   io.WriteCloser
+	opts ndjsonOpts
+
+	started  bool
+	buffered int
+}
+
+// NewNDJSON returns an NDJSONWriter streaming the response to r to w with a
+// 200 status, compressed like every response of the API (see
+// WithCompression and WithEncodeGZIP):
+//
+//	nw := api.NewNDJSON(w, r)
+//	defer nw.Close()
+//	for _, row := range rows {
+//		if err := nw.Encode(row); err != nil {
+//			return
+//		}
+//	}
+func (a *API) NewNDJSON(w http.ResponseWriter, r *http.Request, opts ...NDJSONOptFn) *NDJSONWriter {
+	o := ndjsonOpts{flushEvery: defaultNDJSONFlushEvery}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	return &NDJSONWriter{
+		a:    a,
+		w:    w,
+		r:    r,
+		wc:   noopCloser{Writer: w},
+		opts: o,
+	}
+}
+
+// Encode writes v as the next line. A record failing to encode is skipped
+// with WithNDJSONSkipErrors, otherwise its error is returned and the stream
+// should be abandoned.
+func (n *NDJSONWriter) Encode(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		if n.a != nil && n.a.encodeMetrics != nil {
+			n.a.encodeMetrics(NDJSONMediaType, err)
+		}
+		if n.opts.skipErrors {
+			n.a.logger.
+				WithField("api", "ndjson").
+				Warn("skipping record that failed to encode: ", err)
+			return nil
+		}
+		return err
+	}
+
+	n.start()
+	if _, err := n.wc.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if n.buffered++; n.opts.flushEvery > 0 && n.buffered >= n.opts.flushEvery {
+		return n.Flush()
+	}
+	return nil
+}
+
+// Flush sends the records written so far to the client.
+func (n *NDJSONWriter) Flush() error {
+	n.start()
+	n.buffered = 0
+	if f, ok := n.wc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := http.NewResponseController(n.w).Flush(); !errorsv2.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// Close ends the stream. The response is committed even if no record was
+// written.
+func (n *NDJSONWriter) Close() error {
+	n.start()
+	return n.wc.Close()
+}
+
+// start writes the header before the first record.
+func (n *NDJSONWriter) start() {
+	if n.started {
+		return
+	}
+	n.started = true
+
+	setContextHeaders(n.w.Header(), n.r.Context())
+	n.w.Header().Set("Content-Type", NDJSONMediaType)
+	if coding := n.a.contentCoding(n.w, n.r, http.StatusOK, NDJSONMediaType, -1); coding != "" {
+		n.w.Header().Set("Content-Encoding", coding)
+		n.wc = n.a.compressor(coding)(n.w)
+	}
+	n.w.WriteHeader(http.StatusOK)
+}
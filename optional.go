@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Optional is a field of a JSON request body that tells an absent value
+// apart from an explicit null, as PATCH endpoints need to: an absent field
+// is left unchanged while a null one is cleared. Decoded with DecodeJSON
+// or DecodeRequest, Set reports whether the field was present and Null
+// whether it was null. OK can enforce the semantics of each field, e.g.
+//
+//	type PatchUser struct {
+//		Name  transport.Optional[string] `json:"name"`
+//		Email transport.Optional[string] `json:"email"`
+//	}
+//
+//	func (p PatchUser) OK() error {
+//		if p.Name.Null {
+//			return errors.New("name cannot be cleared")
+//		}
+//		return nil
+//	}
+type Optional[T any] struct {
+	// Value is the decoded value, the zero value when absent or null.
+	Value T
+	// Set reports whether the field was present.
+	Set bool
+	// Null reports whether the field was an explicit null.
+	Null bool
+}
+
+// Some returns an Optional set to v.
+func Some[T any](v T) Optional[T] {
+	return Optional[T]{Value: v, Set: true}
+}
+
+// Get returns the value and whether the field was present and not null.
+func (o Optional[T]) Get() (T, bool) {
+	return o.Value, o.Set && !o.Null
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It is only called for present
+// fields, which is how absent ones are told apart.
+func (o *Optional[T]) UnmarshalJSON(b []byte) error {
+	var zero T
+	o.Value, o.Set, o.Null = zero, true, false
+	if bytes.Equal(bytes.TrimSpace(b), []byte("null")) {
+		o.Null = true
+		return nil
+	}
+	return json.Unmarshal(b, &o.Value)
+}
+
+// MarshalJSON implements json.Marshaler, encoding absent and null values as
+// null.
+func (o Optional[T]) MarshalJSON() ([]byte, error) {
+	if !o.Set || o.Null {
+		return []byte("null"), nil
+	}
+	return json.Marshal(o.Value)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/deepauto-io/errors"
+)
+
+// logPathHolder lets StripPrefix report the path to log to LoggingMW and
+// Metrics, which cannot see its request context when placed outside of it.
+type logPathHolder struct {
+	path string
+}
+
+type logPathKey struct{}
+
+// withLogPathHolder returns a copy of ctx carrying a log path holder,
+// reusing an existing one so every middleware sees the same path.
+func withLogPathHolder(ctx context.Context) (context.Context, *logPathHolder) {
+	if h, ok := ctx.Value(logPathKey{}).(*logPathHolder); ok {
+		return ctx, h
+	}
+	h := &logPathHolder{}
+	return context.WithValue(ctx, logPathKey{}, h), h
+}
+
+// StripPrefixOptFn is a functional option for StripPrefix.
+type StripPrefixOptFn func(*stripPrefixOpts)
+
+type stripPrefixOpts struct {
+	logOriginalPath bool
+}
+
+// WithLogOriginalPath makes LoggingMW and Metrics log the original,
+// unstripped request path. By default they log the stripped path. Either
+// works whether they are placed outside or inside of StripPrefix; with
+// nested StripPrefix middlewares the original path is the outermost one's,
+// the stripped path the innermost one's.
+func WithLogOriginalPath() StripPrefixOptFn {
+	return func(o *stripPrefixOpts) {
+		o.logOriginalPath = true
+	}
+}
+
+// StripPrefix removes prefix from the request URL's Path (and RawPath if set)
+// before calling the next handler, so the same handlers can be mounted under
+// several base paths. Requests whose path does not start with prefix are
+// answered with an errors.ENotFound error.
+func StripPrefix(prefix string, opts ...StripPrefixOptFn) Middleware {
+	var o stripPrefixOpts
+	for _, fn := range opts {
+		fn(&o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		if prefix == "" {
+			return next
+		}
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			p := strings.TrimPrefix(r.URL.Path, prefix)
+			rp := strings.TrimPrefix(r.URL.RawPath, prefix)
+			if len(p) == len(r.URL.Path) || (r.URL.RawPath != "" && len(rp) == len(r.URL.RawPath)) {
+				WriteErrorResponse(r.Context(), w, errors.ENotFound, fmt.Sprintf("path %q not found", r.URL.Path))
+				return
+			}
+
+			ctx, holder := withLogPathHolder(r.Context())
+			if !o.logOriginalPath {
+				holder.path = p
+			} else if holder.path == "" {
+				holder.path = r.URL.Path
+			}
+			r2 := r.Clone(ctx)
+			r2.URL.Path = p
+			r2.URL.RawPath = rp
+			next.ServeHTTP(w, r2)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// RequirePrefix answers requests whose path is not prefix or below it with
+// an errors.ENotFound error, leaving the path of the other requests intact.
+// Unlike StripPrefix the prefix matches whole path segments only, so
+// "/api/v1" matches "/api/v1/users" but not "/api/v10".
+func RequirePrefix(prefix string) Middleware {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(next http.Handler) http.Handler {
+		if prefix == "" {
+			return next
+		}
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			p := r.URL.Path
+			if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+				WriteErrorResponse(r.Context(), w, errors.ENotFound, fmt.Sprintf("path %q not found", r.URL.Path))
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// logPath returns the path LoggingMW should log for r.
+func logPath(r *http.Request) string {
+	if h, ok := r.Context().Value(logPathKey{}).(*logPathHolder); ok && h.path != "" {
+		return h.path
+	}
+	return r.URL.Path
+}
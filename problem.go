@@ -0,0 +1,261 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	errorsv2 "errors"
+	"net/http"
+
+	"github.com/deepauto-io/errors"
+)
+
+// ProblemMediaType is the media type of RFC 7807 problem details.
+const ProblemMediaType = "application/problem+json"
+
+// WithProblemJSON makes Err write RFC 7807 problem details, with the
+// application/problem+json content type, instead of an ErrBody. The type
+// member is typeURI applied to the error code, e.g. a link to the error's
+// documentation, or "about:blank" when typeURI is nil. Problems are never
+// nested in an envelope, and the error function set with WithErrFn is not
+// consulted.
+func WithProblemJSON(typeURI func(code string) string) APIOptFn {
+	return func(api *API) {
+		api.problemJSON = true
+		api.problemTypeFn = typeURI
+	}
+}
+
+// WriteProblemResponse is like WriteErrorResponse but writes the error as
+// problem details.
+func WriteProblemResponse(ctx context.Context, w http.ResponseWriter, code string, msg string) {
+	SetErrorCode(ctx, code)
+	status := ErrorCodeToStatusCode(ctx, code)
+	extensions := map[string]interface{}{"code": code}
+	setProblemRequestID(ctx, extensions)
+	b, _ := json.Marshal(Problem{
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     msg,
+		Extensions: extensions,
+	})
+
+	headers := http.Header{}
+	headers.Set(PlatformErrorCodeHeader, code)
+	headers.Set("Content-Type", ProblemMediaType)
+	writeErrorResponse(w, b, status, headers)
+}
+
+// respondProblem writes err as problem details.
+func (a *API) respondProblem(w http.ResponseWriter, r *http.Request, err error) {
+	p := newProblem(r.Context(), err, a.ErrorCodeToStatusCode)
+	code, _ := p.Extensions["code"].(string)
+	if a.problemTypeFn != nil {
+		p.Type = a.problemTypeFn(code)
+	}
+	p.Instance = r.URL.Path
+
+	setContextHeaders(w.Header(), r.Context())
+	w.Header().Set(PlatformErrorCodeHeader, code)
+	SetErrorCode(r.Context(), code)
+	setRetryAfter(w.Header(), err, a.retryAfter)
+
+	b, mErr := a.marshal(p, a.pretty(r.Context()))
+	if mErr != nil {
+		a.logger.Error("failed to marshal problem details", mErr)
+		WriteProblemResponse(r.Context(), w, errors.EInternal, "an unexpected error occurred")
+		return
+	}
+	w.Header().Set("Content-Type", ProblemMediaType)
+	a.write(w, r, p.Status, b)
+}
+
+// problemMembers are the standard members of a problem details object.
+var problemMembers = map[string]bool{
+	"type":     true,
+	"title":    true,
+	"status":   true,
+	"detail":   true,
+	"instance": true,
+}
+
+// Problem is an RFC 7807 problem details object. Extensions are serialized
+// as additional members of the object, e.g. "invalid_params" or "balance";
+// extensions named like a standard member are dropped so they can never
+// clobber it.
+type Problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	Extensions map[string]interface{}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(p.Extensions)+len(problemMembers))
+	for k, v := range p.Extensions {
+		if !problemMembers[k] {
+			m[k] = v
+		}
+	}
+	typ := p.Type
+	if typ == "" {
+		typ = "about:blank"
+	}
+	m["type"] = typ
+	if p.Title != "" {
+		m["title"] = p.Title
+	}
+	if p.Status != 0 {
+		m["status"] = p.Status
+	}
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Unknown members are collected
+// in Extensions.
+func (p *Problem) UnmarshalJSON(b []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	*p = Problem{}
+	for k, raw := range m {
+		var err error
+		switch k {
+		case "type":
+			err = json.Unmarshal(raw, &p.Type)
+		case "title":
+			err = json.Unmarshal(raw, &p.Title)
+		case "status":
+			err = json.Unmarshal(raw, &p.Status)
+		case "detail":
+			err = json.Unmarshal(raw, &p.Detail)
+		case "instance":
+			err = json.Unmarshal(raw, &p.Instance)
+		default:
+			var v interface{}
+			err = json.Unmarshal(raw, &v)
+			if p.Extensions == nil {
+				p.Extensions = make(map[string]interface{})
+			}
+			p.Extensions[k] = v
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProblemExtender is implemented by errors carrying extension members for
+// their problem details.
+type ProblemExtender interface {
+	ProblemExtensions() map[string]interface{}
+}
+
+type problemExtensionsError struct {
+	err        error
+	extensions map[string]interface{}
+}
+
+// WithProblemExtensions returns err annotated with extension members for its
+// problem details. The error is otherwise unchanged: errors.As and the error
+// code still see the wrapped error.
+func WithProblemExtensions(err error, extensions map[string]interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &problemExtensionsError{
+		err:        err,
+		extensions: extensions,
+	}
+}
+
+func (e *problemExtensionsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *problemExtensionsError) Unwrap() error {
+	return e.err
+}
+
+// ProblemExtensions implements ProblemExtender.
+func (e *problemExtensionsError) ProblemExtensions() map[string]interface{} {
+	return e.extensions
+}
+
+// NewProblem returns the problem details describing err. Besides the
+// standard members it carries the platform error code as the "code"
+// extension, the error details as "details" and the extensions of every
+// ProblemExtender in err's chain, the outermost winning, and the request ID
+// of ctx, if any, as "request_id".
+func NewProblem(ctx context.Context, err error) Problem {
+	return newProblem(ctx, err, ErrorCodeToStatusCode)
+}
+
+func newProblem(ctx context.Context, err error, statusCode func(ctx context.Context, code string) int) Problem {
+	code := errorCode(err)
+	status := statusCode(ctx, code)
+	p := Problem{
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     "An internal error has occurred - check server logs",
+		Extensions: map[string]interface{}{"code": code},
+	}
+	if isPlatformError(err) {
+		p.Detail = errorMessage(err)
+	}
+	if details := errorDetails(err); details != nil {
+		p.Extensions["details"] = details
+	}
+
+	var extenders []ProblemExtender
+	for e := err; e != nil; e = errorsv2.Unwrap(e) {
+		if x, ok := e.(ProblemExtender); ok {
+			extenders = append(extenders, x)
+		}
+	}
+	for i := len(extenders) - 1; i >= 0; i-- {
+		for k, v := range extenders[i].ProblemExtensions() {
+			p.Extensions[k] = v
+		}
+	}
+	setProblemRequestID(ctx, p.Extensions)
+	return p
+}
+
+// setProblemRequestID adds the request ID of ctx as the "request_id"
+// extension, unless extensions already carry one.
+func setProblemRequestID(ctx context.Context, extensions map[string]interface{}) {
+	if _, ok := extensions["request_id"]; ok {
+		return
+	}
+	if id, ok := RequestIDFromContext(ctx); ok {
+		extensions["request_id"] = id
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies is a set of networks whose X-Forwarded-* headers are
+// believed. Headers of requests from any other peer are ignored, since
+// clients can set them to anything. Parse it once at startup with
+// ParseTrustedProxies and share it between middlewares; it is safe for
+// concurrent use. A nil *TrustedProxies trusts nobody.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// ParseTrustedProxies parses CIDRs such as "10.0.0.0/8" or "::1/128". A
+// bare address is treated as a single host network.
+func ParseTrustedProxies(cidrs ...string) (*TrustedProxies, error) {
+	t := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			addr = addr.Unmap()
+			t.prefixes = append(t.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		t.prefixes = append(t.prefixes, prefix.Masked())
+	}
+	return t, nil
+}
+
+// Contains reports whether ip belongs to one of the trusted networks.
+func (t *TrustedProxies) Contains(ip netip.Addr) bool {
+	if t == nil || !ip.IsValid() {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range t.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent r, believing the
+// X-Forwarded-For and X-Real-IP headers of the trustedProxies, given as
+// CIDRs or addresses; invalid entries are ignored. Parse the proxies once
+// with ParseTrustedProxies and use TrustedProxies.ClientIP on hot paths.
+//
+// Without trusted proxies X-Forwarded-For is ignored and the X-Real-IP
+// header, as set by a single reverse proxy, is returned, falling back to
+// the peer address. Any client can set X-Real-IP as well, so only use the
+// result where a spoofed address does no harm, such as in logs.
+func ClientIP(r *http.Request, trustedProxies []string) string {
+	t := &TrustedProxies{}
+	for _, cidr := range trustedProxies {
+		if p, err := ParseTrustedProxies(cidr); err == nil {
+			t.prefixes = append(t.prefixes, p.prefixes...)
+		}
+	}
+	if len(t.prefixes) == 0 {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+		return remoteHost(r)
+	}
+	return t.ClientIP(r)
+}
+
+// ClientIP returns the address of the client that sent r. When the peer is
+// a trusted proxy, X-Forwarded-For is walked from right to left and the
+// first address not belonging to a trusted proxy is returned, falling back
+// to X-Real-IP when there is no X-Forwarded-For. Otherwise the peer address
+// is returned.
+func (t *TrustedProxies) ClientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	if !t.Contains(peer) {
+		return remoteHost(r)
+	}
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// a garbled entry cannot be trusted, nor anything left of it.
+			return hops[i]
+		}
+		if !t.Contains(ip) {
+			return ip.Unmap().String()
+		}
+	}
+	if len(hops) > 0 {
+		// every hop is a trusted proxy, the leftmost is the origin.
+		return hops[0]
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+// ForwardedHost returns the X-Forwarded-Host of r when sent by a trusted
+// proxy, otherwise the Host of r.
+func (t *TrustedProxies) ForwardedHost(r *http.Request) string {
+	if host := t.forwarded(r, "X-Forwarded-Host"); host != "" {
+		return host
+	}
+	return r.Host
+}
+
+// ForwardedProto returns the X-Forwarded-Proto of r when sent by a trusted
+// proxy, otherwise the scheme r was received with, "http" or "https".
+func (t *TrustedProxies) ForwardedProto(r *http.Request) string {
+	if proto := t.forwarded(r, "X-Forwarded-Proto"); proto != "" {
+		return strings.ToLower(proto)
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwarded returns the first value of the X-Forwarded-* header key, the one
+// set by the proxy closest to the client, if the peer is trusted.
+func (t *TrustedProxies) forwarded(r *http.Request, key string) string {
+	if !t.Contains(remoteIP(r)) {
+		return ""
+	}
+	v, _, _ := strings.Cut(r.Header.Get(key), ",")
+	return strings.TrimSpace(v)
+}
+
+// forwardedFor returns the addresses of all X-Forwarded-For headers in order.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// remoteHost returns the host part of r.RemoteAddr.
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func remoteIP(r *http.Request) netip.Addr {
+	ip, _ := netip.ParseAddr(remoteHost(r))
+	return ip
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/deepauto-io/errors"
+)
+
+// defaultLimiterIdleTTL is how long an unused bucket is kept by default.
+const defaultLimiterIdleTTL = 10 * time.Minute
+
+// Limit is a token bucket rate limit: Rate requests per second on average,
+// with bursts of up to Burst requests. A Limit with a Rate <= 0 is unlimited.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitOptions configures RateLimit.
+type RateLimitOptions struct {
+	// Limit is the rate limit of each key.
+	Limit Limit
+	// Key returns the key a request is limited by, e.g. an API key header.
+	// Requests with an empty key are not limited. Defaults to the client IP
+	// as found by TrustedProxies.
+	Key func(r *http.Request) string
+	// TrustedProxies are the proxies whose X-Forwarded-For header is believed
+	// to find the client IP. Defaults to none, limiting by the peer address,
+	// since clients could otherwise get a fresh bucket with every request by
+	// rotating the header.
+	TrustedProxies *TrustedProxies
+	// IdleTTL is how long the state of a key that sent no requests is kept.
+	// Defaults to 10 minutes.
+	IdleTTL time.Duration
+}
+
+// RateLimit returns a middleware limiting the request rate of each key with
+// a token bucket. Rejected requests are answered with an
+// errors.ETooManyRequests error and a Retry-After header.
+func RateLimit(opts RateLimitOptions) Middleware {
+	key := opts.Key
+	if key == nil {
+		key = opts.TrustedProxies.ClientIP
+	}
+	store := newLimiterStore(opts.IdleTTL)
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if k := key(r); k != "" {
+				if ok, wait := store.allow(k, opts.Limit, time.Now()); !ok {
+					writeTooManyRequests(w, r, wait)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// PrincipalRateLimitOptions configures PrincipalRateLimit.
+type PrincipalRateLimitOptions struct {
+	// Limit returns the limit of an authenticated principal, e.g. by looking
+	// up the principal's tier.
+	Limit func(principal string) Limit
+	// Anonymous is the limit applied per client IP to requests without a
+	// principal.
+	Anonymous Limit
+	// TrustedProxies are the proxies whose X-Forwarded-For header is believed
+	// to find the client IP of anonymous requests. Defaults to none, limiting
+	// by the peer address, since anonymous clients could otherwise get a
+	// fresh bucket with every request by rotating the header.
+	TrustedProxies *TrustedProxies
+	// IdleTTL is how long the state of a principal or IP that sent no
+	// requests is kept. Defaults to 10 minutes.
+	IdleTTL time.Duration
+}
+
+// PrincipalRateLimit returns a middleware limiting the request rate of each
+// authenticated principal (see WithPrincipal), falling back to the client IP
+// for anonymous requests. Unlike limiting by IP alone this gives every user
+// a fair quota even when many of them share an address behind a NAT.
+// Rejected requests are answered with an errors.ETooManyRequests error and a
+// Retry-After header.
+func PrincipalRateLimit(opts PrincipalRateLimitOptions) Middleware {
+	store := newLimiterStore(opts.IdleTTL)
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			key, limit := "ip:"+opts.TrustedProxies.ClientIP(r), opts.Anonymous
+			if principal, ok := PrincipalFromContext(r.Context()); ok {
+				key = "principal:" + principal
+				if opts.Limit != nil {
+					limit = opts.Limit(principal)
+				}
+			}
+
+			if ok, wait := store.allow(key, limit, time.Now()); !ok {
+				writeTooManyRequests(w, r, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	err := WithRetryAfter(&errors.Error{
+		Code: errors.ETooManyRequests,
+		Msg:  "rate limit exceeded",
+	}, wait)
+	writeError(r.Context(), w, err)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiterStore holds a token bucket per key and evicts the buckets that
+// have been idle for longer than ttl.
+type limiterStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+func newLimiterStore(ttl time.Duration) *limiterStore {
+	if ttl <= 0 {
+		ttl = defaultLimiterIdleTTL
+	}
+	return &limiterStore{
+		buckets:   make(map[string]*bucket),
+		ttl:       ttl,
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of key. When the bucket is empty it
+// returns false and how long it takes until the next token is available.
+func (s *limiterStore) allow(key string, limit Limit, now time.Time) (bool, time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > s.ttl {
+		for k, b := range s.buckets {
+			if now.Sub(b.last) > s.ttl {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/deepauto-io/errors"
+	"github.com/deepauto-io/log"
+)
+
+// Recoverer recovers from panics in the next handler, logs the panic value
+// with its stack trace and answers with a 500 errors.EInternal error. When
+// the handler already started the response only the panic is logged, since
+// the status line has been sent.
+//
+// A panic with http.ErrAbortHandler is re-raised, so the server aborts the
+// response silently as it does without Recoverer.
+func Recoverer(logger log.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			srw := NewStatusResponseWriter(w)
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
+				logger.WithField("method", r.Method).
+					WithField("path", logPath(r)).
+					WithField("panic", rec).
+					WithField("stack", string(debug.Stack())).
+					Error("recovered from panic")
+
+				if srw.statusCode != 0 || srw.responseBytes > 0 {
+					return
+				}
+				WriteErrorResponse(r.Context(), w, errors.EInternal, "internal error")
+			}()
+			next.ServeHTTP(srw, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
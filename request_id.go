@@ -0,0 +1,137 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// RequestIDHeader is the default header carrying the request id.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the size of incoming request ids.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDHolder lets WithRequestID report the request id to LoggingMW,
+// which cannot see the context of a RequestID middleware placed inside it.
+type requestIDHolder struct {
+	id string
+}
+
+type requestIDHolderKey struct{}
+
+func withRequestIDHolder(ctx context.Context) (context.Context, *requestIDHolder) {
+	if h, ok := ctx.Value(requestIDHolderKey{}).(*requestIDHolder); ok {
+		return ctx, h
+	}
+	h := &requestIDHolder{}
+	return context.WithValue(ctx, requestIDHolderKey{}, h), h
+}
+
+// WithRequestID returns a copy of ctx carrying the request id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	if h, ok := ctx.Value(requestIDHolderKey{}).(*requestIDHolder); ok {
+		h.id = id
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request id set by RequestID.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+type requestIDOpts struct {
+	header   string
+	generate func() string
+}
+
+// RequestIDOptFn is a functional option for RequestID.
+type RequestIDOptFn func(*requestIDOpts)
+
+// WithRequestIDHeader sets the header the request id is read from and
+// echoed in. Defaults to X-Request-Id.
+func WithRequestIDHeader(header string) RequestIDOptFn {
+	return func(o *requestIDOpts) {
+		o.header = header
+	}
+}
+
+// WithRequestIDGenerator sets the function generating the ids of requests
+// without one. Defaults to random (version 4) UUIDs.
+func WithRequestIDGenerator(fn func() string) RequestIDOptFn {
+	return func(o *requestIDOpts) {
+		o.generate = fn
+	}
+}
+
+// RequestID returns a middleware propagating a correlation id. The id of the
+// incoming request header is kept, or a new one is generated when it is
+// absent or malformed. The id is stored on the request context, see
+// RequestIDFromContext, and echoed in the response header.
+func RequestID(opts ...RequestIDOptFn) Middleware {
+	o := requestIDOpts{
+		header:   RequestIDHeader,
+		generate: newUUID,
+	}
+	for _, fn := range opts {
+		fn(&o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(o.header)
+			if !validRequestID(id) {
+				id = o.generate()
+			}
+			w.Header().Set(o.header, id)
+			next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// validRequestID reports whether id is short printable ASCII, so clients
+// cannot inject arbitrary content into logs and downstream headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("transport: reading random bytes: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
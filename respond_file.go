@@ -0,0 +1,195 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	errorsv2 "errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepauto-io/errors"
+)
+
+// RespondReader writes the content read from rd with the given content type.
+//
+// When rd is an io.ReadSeeker the response supports Range requests: single
+// and multiple ranges are answered with 206 Partial Content and the matching
+// Content-Range headers, unsatisfiable ranges with 416, and conditional
+// headers are evaluated against modtime (when not zero). Range responses are
+// never compressed. Any other reader is streamed with a 200 status,
+// compressed according to the API configuration.
+func (a *API) RespondReader(w http.ResponseWriter, r *http.Request, contentType string, modtime time.Time, rd io.Reader) {
+	if rs, ok := rd.(io.ReadSeeker); ok {
+		a.serveContent(w, r, "", contentType, modtime, rs)
+		return
+	}
+
+	setContextHeaders(w.Header(), r.Context())
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	var wc io.WriteCloser = noopCloser{Writer: w}
+	if coding := a.contentCoding(w, r, http.StatusOK, contentType, -1); coding != "" {
+		w.Header().Set("Content-Encoding", coding)
+		wc = a.compressor(coding)(w)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(wc, rd); err != nil {
+		a.logWriteError("respond_reader", "failed to write to response writer: ", err)
+	}
+	if err := wc.Close(); err != nil {
+		a.logWriteError("respond_reader", "failed to close response writer", err)
+	}
+}
+
+// RespondReaderAt is like RespondReader for content of a known size that
+// can be read at arbitrary offsets, and therefore supports Range requests.
+func (a *API) RespondReaderAt(w http.ResponseWriter, r *http.Request, contentType string, modtime time.Time, ra io.ReaderAt, size int64) {
+	a.serveContent(w, r, "", contentType, modtime, io.NewSectionReader(ra, 0, size))
+}
+
+// RespondFile writes the content of the named file, supporting Range and
+// conditional requests like RespondReader does. The content type is derived
+// from the file extension. Missing files are answered with an
+// errors.ENotFound error.
+func (a *API) RespondFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		a.Err(w, r, a.fileError(name, err))
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		a.Err(w, r, a.fileError(name, err))
+		return
+	}
+	if fi.IsDir() {
+		a.Err(w, r, &errors.Error{
+			Code: errors.ENotFound,
+			Msg:  fmt.Sprintf("file %q not found", fi.Name()),
+		})
+		return
+	}
+
+	a.serveContent(w, r, fi.Name(), "", fi.ModTime(), f)
+}
+
+func (a *API) serveContent(w http.ResponseWriter, r *http.Request, name, contentType string, modtime time.Time, rs io.ReadSeeker) {
+	setContextHeaders(w.Header(), r.Context())
+
+	// http.ServeContent answers unsatisfiable ranges with a plain text 416,
+	// check them up front to write the error the same way as any other.
+	if size, ok := unsatisfiableRange(r, rs); ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		a.Err(w, r, &errors.Error{
+			Code: ERangeNotSatisfiable,
+			Msg:  fmt.Sprintf("range %q not satisfiable for %d bytes", r.Header.Get("Range"), size),
+		})
+		return
+	}
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, r, name, modtime, rs)
+}
+
+// unsatisfiableRange reports whether none of the byte ranges requested by r
+// overlap the content of rs, returning the content size. Requests
+// http.ServeContent would not serve a range for are never unsatisfiable.
+func unsatisfiableRange(r *http.Request, rs io.ReadSeeker) (int64, bool) {
+	header := r.Header.Get("Range")
+	if header == "" || r.Header.Get("If-Range") != "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return 0, false
+	}
+	specs, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, false
+	}
+
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil || size == 0 {
+		// empty content is served whole rather than with a 416.
+		return 0, false
+	}
+
+	for _, spec := range strings.Split(specs, ",") {
+		start, end, ok := strings.Cut(strings.TrimSpace(spec), "-")
+		if !ok {
+			return 0, false
+		}
+		if start == "" {
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			if n > 0 {
+				return 0, false
+			}
+			continue
+		}
+		i, err := strconv.ParseInt(start, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		if i < size {
+			return 0, false
+		}
+	}
+	return size, true
+}
+
+// fileError shapes err, a failure to open or stat the named file, for the
+// client. The messages carry the base name only, so the server's directory
+// layout is not disclosed. Unexpected errors are logged in full.
+func (a *API) fileError(name string, err error) error {
+	switch {
+	case errorsv2.Is(err, fs.ErrNotExist):
+		return &errors.Error{
+			Code: errors.ENotFound,
+			Msg:  fmt.Sprintf("file %q not found", filepath.Base(name)),
+		}
+	case errorsv2.Is(err, fs.ErrPermission):
+		return &errors.Error{
+			Code: errors.EForbidden,
+			Msg:  fmt.Sprintf("file %q is not accessible", filepath.Base(name)),
+		}
+	}
+	if a != nil && a.logger != nil {
+		a.logger.
+			WithField("api", "respond_file").
+			Error("failed to read file: ", err)
+	}
+	return &errors.Error{
+		Code: errors.EInternal,
+		Msg:  "failed to read file",
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// RespondStream is like Respond but always writes JSON, encoding v straight
+// to the response, compressed according to the API configuration, instead
+// of marshaling it into memory first. This keeps memory flat for megabyte
+// scale payloads such as large lists.
+//
+// The tradeoff is that the status is written before encoding starts, so an
+// encoding error half way through can no longer turn the response into an
+// error: the client gets a truncated body with the original status and the
+// error is only logged. Respond remains the safe default; use RespondStream
+// for large payloads of types that are known to encode.
+func (a *API) RespondStream(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if a != nil && a.envelope {
+		v = Envelope{Success: true, Data: v}
+	}
+
+	setContextHeaders(w.Header(), r.Context())
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	var wc io.WriteCloser = noopCloser{Writer: w}
+	if coding := a.contentCoding(w, r, status, "application/json; charset=utf-8", -1); coding != "" {
+		w.Header().Set("Content-Encoding", coding)
+		wc = a.compressor(coding)(w)
+	}
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(wc)
+	if a.pretty(r.Context()) {
+		enc.SetIndent("", "\t")
+	}
+	if err := enc.Encode(v); err != nil {
+		if a != nil && a.encodeMetrics != nil {
+			a.encodeMetrics(jsonMediaType, err)
+		}
+		a.logWriteError("respond_stream", "failed to encode response: ", err)
+	}
+	if err := wc.Close(); err != nil {
+		a.logWriteError("respond_stream", "failed to close response writer", err)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type warningsKey struct{}
+
+// WithWarning returns a copy of ctx carrying text as an additional response
+// warning. Warnings accumulate, so handlers may call it several times (e.g.
+// once per deprecated field) and Respond emits each of them as a Warning
+// header with the 299 (miscellaneous persistent warning) code.
+func WithWarning(ctx context.Context, text string) context.Context {
+	prev := Warnings(ctx)
+	warnings := make([]string, len(prev), len(prev)+1)
+	copy(warnings, prev)
+	return context.WithValue(ctx, warningsKey{}, append(warnings, text))
+}
+
+// Warnings returns the warnings accumulated on ctx by WithWarning.
+func Warnings(ctx context.Context) []string {
+	warnings, _ := ctx.Value(warningsKey{}).([]string)
+	return warnings
+}
+
+type preloadsKey struct{}
+
+// PreloadLink is a resource the client should fetch early, emitted as a
+// "Link: <url>; rel=preload" header.
+type PreloadLink struct {
+	URL string
+	// As is the destination of the resource, e.g. "script", "style" or "font".
+	As string
+	// Type optionally sets the MIME type, so clients skip unsupported types.
+	Type string
+	// CrossOrigin optionally sets the CORS mode, "anonymous" or
+	// "use-credentials". Fonts must be preloaded with CORS.
+	CrossOrigin string
+}
+
+func (l PreloadLink) String() string {
+	var sb strings.Builder
+	sb.WriteString("<" + l.URL + ">; rel=preload")
+	if l.As != "" {
+		sb.WriteString("; as=" + l.As)
+	}
+	if l.Type != "" {
+		sb.WriteString(`; type="` + quotedStringEscaper.Replace(l.Type) + `"`)
+	}
+	if l.CrossOrigin != "" {
+		sb.WriteString("; crossorigin=" + l.CrossOrigin)
+	}
+	return sb.String()
+}
+
+// WithPreload returns a copy of ctx carrying link as an additional resource
+// to preload. Like warnings, preload links accumulate and Respond emits each
+// of them as a Link header, in the order they were added.
+func WithPreload(ctx context.Context, link PreloadLink) context.Context {
+	prev := Preloads(ctx)
+	links := make([]PreloadLink, len(prev), len(prev)+1)
+	copy(links, prev)
+	return context.WithValue(ctx, preloadsKey{}, append(links, link))
+}
+
+// Preloads returns the links accumulated on ctx by WithPreload.
+func Preloads(ctx context.Context) []PreloadLink {
+	links, _ := ctx.Value(preloadsKey{}).([]PreloadLink)
+	return links
+}
+
+var quotedStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// setContextHeaders adds the response headers accumulated on ctx to h. Values
+// that are already present are not added again, so it is safe to call more
+// than once for the same response.
+func setContextHeaders(h http.Header, ctx context.Context) {
+	for _, text := range Warnings(ctx) {
+		addHeaderOnce(h, "Warning", `299 - "`+quotedStringEscaper.Replace(text)+`"`)
+	}
+	for _, link := range Preloads(ctx) {
+		addHeaderOnce(h, "Link", link.String())
+	}
+}
+
+func addHeaderOnce(h http.Header, key, value string) {
+	for _, v := range h.Values(key) {
+		if v == value {
+			return
+		}
+	}
+	h.Add(key, value)
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	errorsv2 "errors"
+	"net/http"
+
+	"github.com/deepauto-io/log"
+)
+
+// ErrResponseTooLarge is returned by writes exceeding the limit set with
+// MaxResponseBytes.
+var ErrResponseTooLarge = errorsv2.New("response exceeds the maximum size")
+
+// MaxResponseBytes returns a middleware cutting off responses longer than n
+// bytes, e.g. the result of an accidentally unbounded query, before they
+// exhaust the egress budget. As the status has already been sent by then, the
+// response is merely truncated: writes beyond the limit fail with
+// ErrResponseTooLarge and the incident is logged at Error level, so it is
+// caught in testing. n <= 0 disables the limit.
+func MaxResponseBytes(logger log.Logger, n int) Middleware {
+	return func(next http.Handler) http.Handler {
+		if n <= 0 {
+			return next
+		}
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			srw := NewStatusResponseWriter(w)
+			srw.maxBytes = n
+			srw.onTruncate = func() {
+				logger.WithField("method", r.Method).
+					WithField("path", logPath(r)).
+					WithField("status_code", srw.Code()).
+					WithField("max_bytes", n).
+					Error("response truncated at the maximum size")
+			}
+			next.ServeHTTP(srw, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	errorsv2 "errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/deepauto-io/errors"
+)
+
+// defaultRetryableCodes are the error codes of transient failures.
+var defaultRetryableCodes = map[string]bool{
+	errors.EUnavailable:     true,
+	errors.ETooManyRequests: true,
+	errors.EBadGateway:      true,
+	ERequestTimeout:         true,
+}
+
+type retryableOpts struct {
+	method string
+	codes  map[string]bool
+	policy func(err error) (retryable, ok bool)
+}
+
+// RetryableOptFn is a functional option for IsRetryable.
+type RetryableOptFn func(*retryableOpts)
+
+// WithRetryMethod sets the method of the failed request. Requests with a
+// method that is not idempotent, such as POST, are only retried when the
+// server surely did not process them.
+func WithRetryMethod(method string) RetryableOptFn {
+	return func(o *retryableOpts) {
+		o.method = method
+	}
+}
+
+// WithRetryableCodes replaces the error codes considered transient, by
+// default errors.EUnavailable, errors.ETooManyRequests, errors.EBadGateway
+// and ERequestTimeout.
+func WithRetryableCodes(codes ...string) RetryableOptFn {
+	return func(o *retryableOpts) {
+		o.codes = make(map[string]bool, len(codes))
+		for _, code := range codes {
+			o.codes[code] = true
+		}
+	}
+}
+
+// WithRetryPolicy sets a policy consulted before the default one. When ok
+// is false the default policy decides.
+func WithRetryPolicy(fn func(err error) (retryable, ok bool)) RetryableOptFn {
+	return func(o *retryableOpts) {
+		o.policy = fn
+	}
+}
+
+// IsRetryable reports whether the request that failed with err, e.g. as
+// returned by CheckError or an http.Client, is worth retrying. Errors with a
+// transient error code and network errors such as refused or reset
+// connections and timeouts are retryable, while canceled contexts are not.
+// Centralizing the decision keeps clients consistent.
+func IsRetryable(err error, opts ...RetryableOptFn) bool {
+	if err == nil {
+		return false
+	}
+	o := retryableOpts{codes: defaultRetryableCodes}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	if o.policy != nil {
+		if retryable, ok := o.policy(err); ok {
+			return retryable
+		}
+	}
+
+	if errorsv2.Is(err, context.Canceled) || errorsv2.Is(err, context.DeadlineExceeded) {
+		// the caller gave up, retrying would not be waited for.
+		return false
+	}
+
+	// these failures happen before the server sees the request, so even
+	// requests that are not idempotent are safe to retry.
+	if errorsv2.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	if isPlatformError(err) && errorCode(err) == errors.ETooManyRequests {
+		return o.codes[errors.ETooManyRequests]
+	}
+	if !idempotent(o.method) {
+		return false
+	}
+
+	if isPlatformError(err) {
+		return o.codes[errorCode(err)]
+	}
+	var netErr net.Error
+	if errorsv2.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errorsv2.Is(err, syscall.ECONNRESET) ||
+		errorsv2.Is(err, io.ErrUnexpectedEOF) ||
+		errorsv2.Is(err, io.EOF)
+}
+
+// idempotent reports whether requests with method may be repeated without
+// changing the outcome. An unknown, empty, method is assumed idempotent.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPatch, http.MethodConnect:
+		return false
+	}
+	return true
+}
+
+// RetryOptions configures DoWithRetry.
+type RetryOptions struct {
+	// Client sends the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one. Defaults to 3.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled for every
+	// further retry. Defaults to 100ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential backoff. A longer Retry-After sent by
+	// the server is still honored. Defaults to 10s.
+	MaxDelay time.Duration
+	// Retryable overrides the policy of IsRetryable, see WithRetryPolicy.
+	Retryable func(err error) (retryable, ok bool)
+}
+
+// DoWithRetry sends req, checks the response with CheckError and retries
+// the request while it fails with a retryable error, see IsRetryable, as
+// long as ctx is not done. Retries back off exponentially, waiting at least
+// as long as a Retry-After header asks for. Requests with a body are only
+// retried if req.GetBody is set, as it is by http.NewRequest for common
+// body types.
+//
+// On success the response is returned with its body unread, and the caller
+// must close it. Otherwise the error of the last attempt is returned.
+func DoWithRetry(ctx context.Context, req *http.Request, opts RetryOptions) (*http.Response, error) {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	attempts := opts.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	delay := opts.BaseDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	maxDelay := opts.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = 10 * time.Second
+	}
+	retryOpts := []RetryableOptFn{
+		WithRetryMethod(req.Method),
+		WithRetryableCodes(errors.EUnavailable, errors.ETooManyRequests, errors.EBadGateway),
+	}
+	if opts.Retryable != nil {
+		retryOpts = append(retryOpts, WithRetryPolicy(opts.Retryable))
+	}
+
+	req = req.WithContext(ctx)
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		if err == nil {
+			if err = CheckError(resp); err == nil {
+				return resp, nil
+			}
+			resp.Body.Close()
+		}
+
+		canReplay := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if attempt >= attempts || !canReplay || !IsRetryable(err, retryOpts...) {
+			return nil, err
+		}
+
+		wait := delay
+		if after, ok := RetryAfter(err); ok && after > wait {
+			wait = after
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
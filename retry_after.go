@@ -0,0 +1,93 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	errorsv2 "errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryAfterError attaches a retry hint to an error.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// WithRetryAfter annotates err with how long clients should wait before
+// retrying. The hint is written as a Retry-After header when the error is
+// written to a response and takes precedence over any per-code default.
+func WithRetryAfter(err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err: err, after: d}
+}
+
+// RetryAfter returns the retry hint attached to err, if any.
+func RetryAfter(err error) (time.Duration, bool) {
+	var rerr *retryAfterError
+	if errorsv2.As(err, &rerr) {
+		return rerr.after, true
+	}
+	return 0, false
+}
+
+// parseRetryAfter parses a Retry-After header value, either delay-seconds or
+// an HTTP-date, relative to now. Dates in the past yield a zero delay.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 || secs > math.MaxInt64/int64(time.Second) {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// setRetryAfter sets the Retry-After header from the hint attached to err,
+// falling back to the default for the error's code.
+func setRetryAfter(h http.Header, err error, defaults map[string]time.Duration) {
+	d, ok := RetryAfter(err)
+	if !ok {
+		d, ok = defaults[errorCode(err)]
+	}
+	if !ok || d <= 0 {
+		return
+	}
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
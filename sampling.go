@@ -0,0 +1,86 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+type sampledKey struct{}
+
+// WithSampled returns a copy of ctx carrying the sampling decision.
+func WithSampled(ctx context.Context, sampled bool) context.Context {
+	return context.WithValue(ctx, sampledKey{}, sampled)
+}
+
+// Sampled reports whether the request of ctx is sampled for tracing. It is
+// false when no decision has been made, see Sampling.
+func Sampled(ctx context.Context) bool {
+	sampled, _ := ctx.Value(sampledKey{}).(bool)
+	return sampled
+}
+
+// Sampling returns a middleware making a head-based sampling decision once
+// per request and storing it on the request context, so every span and
+// outbound call of the request agrees on it (see Sampled). A request with a
+// valid W3C traceparent header follows its sampled flag, so traces are kept
+// or dropped as a whole across services. Other requests are sampled with
+// probability rate, between 0 and 1.
+func Sampling(rate float64) Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			sampled, ok := traceparentSampled(r.Header.Get("traceparent"))
+			if !ok {
+				sampled = rate >= 1 || (rate > 0 && rand.Float64() < rate)
+			}
+			next.ServeHTTP(w, r.WithContext(WithSampled(r.Context(), sampled)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// traceparentSampled returns the sampled flag of a traceparent header of the
+// form "version-traceid-parentid-flags". ok is false when the header is
+// absent or malformed.
+func traceparentSampled(header string) (sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return false, false
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) ||
+		len(traceID) != 32 || len(parentID) != 16 || len(flags) != 2 {
+		return false, false
+	}
+	for _, s := range []string{version, traceID, parentID} {
+		if _, err := hex.DecodeString(s); err != nil {
+			return false, false
+		}
+	}
+	if traceID == strings.Repeat("0", 32) || parentID == strings.Repeat("0", 16) {
+		return false, false
+	}
+	b, err := hex.DecodeString(flags)
+	if err != nil {
+		return false, false
+	}
+	return b[0]&0x01 == 0x01, true
+}
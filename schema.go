@@ -0,0 +1,162 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/deepauto-io/errors"
+)
+
+// SchemaViolation describes a part of a document not satisfying a schema.
+type SchemaViolation struct {
+	// Field locates the offending value, e.g. as a JSON pointer.
+	Field   string `json:"field" xml:"field"`
+	Message string `json:"message" xml:"message"`
+}
+
+// JSONSchema is a compiled JSON Schema, usually an adapter around a JSON
+// Schema library.
+type JSONSchema interface {
+	// Validate returns the violations found in doc, a JSON document decoded
+	// into generic values (maps, slices, strings, json.Number, bools and nil).
+	Validate(doc interface{}) []SchemaViolation
+}
+
+// SchemaError is an errors.EInvalid error listing the schema violations of
+// a request body. The violations are included in the error response details.
+type SchemaError struct {
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("request body does not match schema: %d violation(s)", len(e.Violations))
+}
+
+// Unwrap exposes the platform error, so the error maps to a 400.
+func (e *SchemaError) Unwrap() error {
+	return &errors.Error{
+		Code: errors.EInvalid,
+		Msg:  e.Error(),
+	}
+}
+
+// ErrorDetails implements ErrorDetailer.
+func (e *SchemaError) ErrorDetails() interface{} {
+	return e.Violations
+}
+
+// defaultMaxSchemaBodyBytes is the default limit of a request body read by
+// ValidateJSONSchema.
+const defaultMaxSchemaBodyBytes = 10 << 20
+
+// SchemaOptFn is a functional option for ValidateJSONSchema.
+type SchemaOptFn func(*schemaOpts)
+
+type schemaOpts struct {
+	maxBytes int64
+}
+
+// WithSchemaMaxBytes limits the request bodies ValidateJSONSchema reads to n
+// bytes. Defaults to 10 MiB.
+func WithSchemaMaxBytes(n int64) SchemaOptFn {
+	return func(o *schemaOpts) {
+		o.maxBytes = n
+	}
+}
+
+// ValidateJSONSchema returns a middleware validating JSON request bodies
+// against schema without decoding them into Go types, e.g. at the edge of a
+// gateway. Invalid bodies are rejected with a SchemaError. Valid bodies are
+// restored so the next handler can read them as if untouched. GET, HEAD,
+// OPTIONS and TRACE requests, empty bodies and bodies whose Content-Type is
+// not JSON (application/json or a +json type) are passed on unchecked, and
+// bodies over the size limit are rejected with an errors.ETooLarge error.
+func ValidateJSONSchema(schema JSONSchema, opts ...SchemaOptFn) Middleware {
+	o := schemaOpts{maxBytes: defaultMaxSchemaBodyBytes}
+	for _, fn := range opts {
+		fn(&o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if safeMethod(r.Method) || r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 || !jsonContentType(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > o.maxBytes {
+				WriteErrorResponse(r.Context(), w, errors.ETooLarge, fmt.Sprintf("request body exceeds %d bytes", o.maxBytes))
+				return
+			}
+
+			body := &maxBodyReader{
+				rc:    http.MaxBytesReader(w, r.Body, o.maxBytes),
+				limit: o.maxBytes,
+			}
+			b, err := io.ReadAll(body)
+			if err != nil {
+				if !isPlatformError(err) {
+					err = &errors.Error{
+						Code: errors.EInvalid,
+						Msg:  "failed to read request body",
+						Err:  err,
+					}
+				}
+				writeError(r.Context(), w, err)
+				return
+			}
+			_ = r.Body.Close()
+			if len(b) == 0 {
+				r.Body = http.NoBody
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			dec := json.NewDecoder(bytes.NewReader(b))
+			dec.UseNumber()
+			var doc interface{}
+			if err := dec.Decode(&doc); err != nil {
+				writeError(r.Context(), w, &errors.Error{
+					Code: errors.EInvalid,
+					Msg:  fmt.Sprintf("failed to unmarshal json: %s", err),
+				})
+				return
+			}
+			if violations := schema.Validate(doc); len(violations) > 0 {
+				writeError(r.Context(), w, &SchemaError{Violations: violations})
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(b))
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// jsonContentType reports whether the Content-Type of r is application/json
+// or a structured syntax type such as application/merge-patch+json.
+func jsonContentType(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == jsonMediaType || strings.HasSuffix(mediaType, "+json")
+}
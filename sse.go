@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Event is a server-sent event.
+type Event struct {
+	// ID is sent as the event's id field. Clients send the ID of the last
+	// event they received in the Last-Event-ID header when reconnecting.
+	ID string
+	// Event is the event type, "message" when empty.
+	Event string
+	// Data is the event payload. Strings and byte slices are sent as is,
+	// anything else is encoded as JSON.
+	Data interface{}
+	// Retry, when positive, tells the client how long to wait before
+	// reconnecting after the connection is lost.
+	Retry time.Duration
+}
+
+// EventSender sends an event to the client and flushes it.
+type EventSender func(e Event) error
+
+var sseFieldSanitizer = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
+
+// RespondEvents streams server-sent events (text/event-stream) produced by
+// fn until it returns or the client goes away, which cancels ctx. fn
+// receives the Last-Event-ID header of the request, empty on the first
+// connection, so it can resume after the last event the client saw.
+//
+// The response status is 200 once streaming starts, so errors returned by
+// fn are only logged.
+func (a *API) RespondEvents(w http.ResponseWriter, r *http.Request, fn func(ctx context.Context, lastEventID string, send EventSender) error) {
+	setContextHeaders(w.Header(), r.Context())
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// stop reverse proxies such as nginx from buffering the stream.
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	_ = rc.Flush()
+
+	send := func(e Event) error {
+		if err := a.writeEvent(w, e); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err := fn(r.Context(), r.Header.Get("Last-Event-ID"), send); err != nil && r.Context().Err() == nil {
+		a.logWriteError("respond_events", "failed to stream events: ", err)
+	}
+}
+
+func (a *API) writeEvent(w io.Writer, e Event) error {
+	var sb strings.Builder
+	if e.ID != "" {
+		sb.WriteString("id: " + sseFieldSanitizer.Replace(e.ID) + "\n")
+	}
+	if e.Event != "" {
+		sb.WriteString("event: " + sseFieldSanitizer.Replace(e.Event) + "\n")
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&sb, "retry: %d\n", e.Retry.Milliseconds())
+	}
+
+	var data string
+	switch d := e.Data.(type) {
+	case nil:
+	case string:
+		data = d
+	case []byte:
+		data = string(d)
+	default:
+		b, err := a.marshal(d, false)
+		if err != nil {
+			return err
+		}
+		data = string(b)
+	}
+	if e.Data != nil {
+		// every line of the payload needs its own data field.
+		data = strings.ReplaceAll(data, "\r\n", "\n")
+		for _, line := range strings.Split(data, "\n") {
+			sb.WriteString("data: " + line + "\n")
+		}
+	}
+	sb.WriteString("\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -1,6 +1,11 @@
 package transport
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash"
+	"net"
 	"net/http"
 )
 
@@ -8,7 +13,15 @@ import (
 // status code and the number of bytes written.
 type StatusResponseWriter struct {
 	statusCode    int
+	wroteHeader   bool
 	responseBytes int
+	timedOut      bool
+	hash          hash.Hash
+	body          *bytes.Buffer
+	maxBodyBytes  int
+	maxBytes      int
+	truncated     bool
+	onTruncate    func()
 	http.ResponseWriter
 }
 
@@ -19,13 +32,63 @@ func NewStatusResponseWriter(w http.ResponseWriter) *StatusResponseWriter {
 	}
 }
 
+// NewStatusResponseWriterWithCapture returns a new StatusResponseWriter that
+// additionally keeps the first maxBytes bytes of the response body, e.g. for
+// an audit log. See Body.
+func NewStatusResponseWriterWithCapture(w http.ResponseWriter, maxBytes int) *StatusResponseWriter {
+	return &StatusResponseWriter{
+		ResponseWriter: w,
+		body:           &bytes.Buffer{},
+		maxBodyBytes:   maxBytes,
+	}
+}
+
 // Write writes the bytes to the ResponseWriter and captures the number of bytes written.
 func (w *StatusResponseWriter) Write(b []byte) (int, error) {
+	if w.truncated {
+		return 0, ErrResponseTooLarge
+	}
+	var tooLarge bool
+	if w.maxBytes > 0 && w.responseBytes+len(b) > w.maxBytes {
+		b, tooLarge = b[:w.maxBytes-w.responseBytes], true
+	}
+
+	// writing the body implies a 200 OK header.
+	w.wroteHeader = true
 	n, err := w.ResponseWriter.Write(b)
 	w.responseBytes += n
+	if w.hash != nil {
+		w.hash.Write(b[:n])
+	}
+	if w.body != nil {
+		if room := w.maxBodyBytes - w.body.Len(); room > 0 {
+			if room > n {
+				room = n
+			}
+			w.body.Write(b[:room])
+		}
+	}
+	if err == http.ErrHandlerTimeout {
+		// http.TimeoutHandler has already written its own 503 response and
+		// swallows everything the handler writes afterwards.
+		w.timedOut = true
+	}
+	if tooLarge && err == nil {
+		w.truncated = true
+		if w.onTruncate != nil {
+			w.onTruncate()
+		}
+		err = ErrResponseTooLarge
+	}
 	return n, err
 }
 
+// Truncated reports whether the response was cut off at the limit set by
+// MaxResponseBytes.
+func (w *StatusResponseWriter) Truncated() bool {
+	return w.truncated
+}
+
 // Flush flushes the ResponseWriter if it implements http.Flusher.
 func (w *StatusResponseWriter) Flush() {
 	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
@@ -33,14 +96,61 @@ func (w *StatusResponseWriter) Flush() {
 	}
 }
 
-// WriteHeader writes the header and captures the status code.
+// Hijack lets the handler take over the connection, e.g. to upgrade it to a
+// WebSocket, if the ResponseWriter implements http.Hijacker.
+func (w *StatusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not implement http.Hijacker", w.ResponseWriter)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.statusCode == 0 {
+		// the connection now belongs to the handler, which typically answers
+		// with 101 Switching Protocols.
+		w.statusCode = http.StatusSwitchingProtocols
+		w.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Push initiates an HTTP/2 server push if the ResponseWriter implements
+// http.Pusher, and returns http.ErrNotSupported otherwise.
+func (w *StatusResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := w.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController can
+// reach the optional interfaces it implements.
+func (w *StatusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// WriteHeader writes the header and captures the status code. Calls after
+// the header was written, explicitly or by Write, are ignored, so recovery
+// and error middleware can write an error without checking whether the
+// handler already responded. Informational 1xx headers, such as 103 Early
+// Hints, may precede the final header.
 func (w *StatusResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	w.wroteHeader = true
 	w.statusCode = statusCode
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
 // Code returns the status code.
 func (w *StatusResponseWriter) Code() int {
+	if w.timedOut {
+		return http.StatusServiceUnavailable
+	}
 	code := w.statusCode
 	if code == 0 {
 		// When statusCode is 0 then WriteHeader was never called and we can assume that
@@ -50,6 +160,31 @@ func (w *StatusResponseWriter) Code() int {
 	return code
 }
 
+// TimedOut reports whether a write failed with http.ErrHandlerTimeout, meaning
+// an enclosing http.TimeoutHandler answered the request instead of the handler.
+func (w *StatusResponseWriter) TimedOut() bool {
+	return w.timedOut
+}
+
+// ETag returns the entity tag of the bytes written so far, or an empty string
+// when the writer does not hash the response (see ETagTrailer).
+func (w *StatusResponseWriter) ETag() string {
+	if w.hash == nil {
+		return ""
+	}
+	return formatETag(w.hash.Sum(nil))
+}
+
+// Body returns the captured start of the response body as written, i.e.
+// compressed if the handler compressed it. It is nil unless the writer was
+// created with NewStatusResponseWriterWithCapture.
+func (w *StatusResponseWriter) Body() []byte {
+	if w.body == nil {
+		return nil
+	}
+	return w.body.Bytes()
+}
+
 // ResponseBytes returns the number of bytes written.
 func (w *StatusResponseWriter) ResponseBytes() int {
 	return w.responseBytes
@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusResponseWriterHijack(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srw := NewStatusResponseWriter(w)
+		conn, rw, err := srw.Hijack()
+		if err != nil {
+			t.Errorf("Hijack() error = %v", err)
+			return
+		}
+		defer conn.Close()
+
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			t.Errorf("reading from hijacked connection: %v", err)
+			return
+		}
+		if _, err := rw.WriteString("echo: " + line); err != nil {
+			t.Errorf("writing to hijacked connection: %v", err)
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			t.Errorf("flushing hijacked connection: %v", err)
+		}
+		if got := srw.Code(); got != http.StatusSwitchingProtocols {
+			t.Errorf("Code() = %d, want %d", got, http.StatusSwitchingProtocols)
+		}
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\nping\n"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "echo: ping\n"; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestStatusResponseWriterHijackNotSupported(t *testing.T) {
+	srw := NewStatusResponseWriter(httptest.NewRecorder())
+	if _, _, err := srw.Hijack(); err == nil {
+		t.Error("Hijack() on a recorder succeeded, want an error")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// DecodeJSONStream decodes a stream of JSON values, such as an NDJSON
+// request body, calling fn with each value in the order it arrives. Every
+// value is validated the same way DecodeJSON validates a single value, and
+// the API's JSON options, such as WithStrictJSON and WithJSONKeyResolver,
+// apply.
+// Decoding stops at the first error from decoding or from fn.
+func DecodeJSONStream[T any](a *API, r io.Reader, fn func(v T) error) error {
+	dec := a.jsonDecoder(a.limitBody(r))
+	for {
+		var v T
+		if err := dec.Decode(&v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return a.unmarshalErr("json", err)
+		}
+		// validate v itself when T is a pointer type such as *Record, whose
+		// OK method &v, a **Record, would not have. A null is left to fn.
+		target := interface{}(&v)
+		if _, ok := interface{}(v).(oker); ok {
+			target = v
+			if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+				target = nil
+			}
+		}
+		if err := a.validate(target); err != nil {
+			return err
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+}
+
+// StreamOptions configures ProcessJSONStream.
+type StreamOptions struct {
+	// Workers is the number of values processed concurrently. Defaults to 1.
+	Workers int
+	// Buffer is the number of decoded values that may wait for a free worker
+	// before decoding blocks. Defaults to Workers.
+	Buffer int
+}
+
+// ProcessJSONStream decodes a stream of JSON values from r like
+// DecodeJSONStream and hands them to a bounded pool of workers calling fn.
+// Once the buffer is full decoding blocks, so a fast client cannot outrun
+// the processing and memory use stays bounded.
+//
+// The first error, from either decoding or fn, cancels the context passed to
+// the workers, stops reading the stream and is returned once all workers
+// have finished. It can be passed straight to API.Err.
+func ProcessJSONStream[T any](ctx context.Context, a *API, r io.Reader, opts StreamOptions, fn func(ctx context.Context, v T) error) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	buffer := opts.Buffer
+	if buffer <= 0 {
+		buffer = workers
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		once     sync.Once
+		firstErr error
+	)
+	setErr := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	values := make(chan T, buffer)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := range values {
+				if ctx.Err() != nil {
+					// drain the remaining values once aborted.
+					continue
+				}
+				if err := fn(ctx, v); err != nil {
+					setErr(err)
+				}
+			}
+		}()
+	}
+
+	err := DecodeJSONStream(a, r, func(v T) error {
+		select {
+		case values <- v:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if err != nil {
+		setErr(err)
+	}
+	close(values)
+	wg.Wait()
+
+	return firstErr
+}
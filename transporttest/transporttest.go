@@ -0,0 +1,119 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package transporttest provides helpers for testing handlers built on
+// the transport package.
+package transporttest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/deepauto-io/transport"
+)
+
+// RecordResponse runs a.Respond against an httptest.ResponseRecorder and
+// returns the recorded status code, headers and body. When the response
+// is gzip encoded the body is decompressed before being returned.
+func RecordResponse(a *transport.API, status int, v interface{}) (code int, header http.Header, body []byte, err error) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	a.Respond(w, r, status, v)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	body, err = readBody(resp)
+	return resp.StatusCode, resp.Header, body, err
+}
+
+func readBody(resp *http.Response) ([]byte, error) {
+	var rd io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		rd = gr
+	}
+	return io.ReadAll(rd)
+}
+
+// DecodeErrBody reads the error response resp, decompressing a gzip encoded
+// body, and decodes its ErrBody. The code falls back to the
+// X-Platform-Error-Code header when the body has none. The body is left
+// readable for further assertions.
+func DecodeErrBody(resp *http.Response) (transport.ErrBody, error) {
+	var eb transport.ErrBody
+	raw, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+	if err != nil {
+		return eb, err
+	}
+
+	body, err := readBody(&http.Response{
+		Header: resp.Header,
+		Body:   io.NopCloser(bytes.NewReader(raw)),
+	})
+	if err != nil {
+		return eb, err
+	}
+	if err := json.Unmarshal(body, &eb); err != nil {
+		return eb, fmt.Errorf("decoding error body %q: %w", body, err)
+	}
+	if eb.Code == "" {
+		eb.Code = resp.Header.Get(transport.PlatformErrorCodeHeader)
+	}
+	return eb, nil
+}
+
+// AssertStatus fails the test when resp does not have the status code. The
+// failure message includes the error code and message of error responses.
+func AssertStatus(t testing.TB, resp *http.Response, code int) {
+	t.Helper()
+	if resp.StatusCode == code {
+		return
+	}
+	if eb, err := DecodeErrBody(resp); err == nil && eb.Code != "" {
+		t.Errorf("got status %d, want %d: %s: %s", resp.StatusCode, code, eb.Code, eb.Msg)
+		return
+	}
+	t.Errorf("got status %d, want %d", resp.StatusCode, code)
+}
+
+// AssertErrorCode fails the test when resp is not an error response with
+// the error code, as reported by its X-Platform-Error-Code header or body.
+func AssertErrorCode(t testing.TB, resp *http.Response, code string) {
+	t.Helper()
+	eb, err := DecodeErrBody(resp)
+	if err != nil {
+		t.Errorf("want error code %q: %v", code, err)
+		return
+	}
+	if eb.Code != code {
+		t.Errorf("got error code %q, want %q: %s", eb.Code, code, eb.Msg)
+	}
+}
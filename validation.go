@@ -0,0 +1,99 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	errorsv2 "errors"
+	"fmt"
+	"sort"
+
+	"github.com/deepauto-io/errors"
+)
+
+// FieldError describes an invalid field of a request.
+type FieldError struct {
+	Field   string `json:"field" xml:"field"`
+	Message string `json:"message" xml:"message"`
+}
+
+// FieldErrorer is implemented by validation errors that know which fields
+// are invalid, mapping each field to its message. An OK method returning a
+// FieldErrorer gets a structured error response listing the fields, so
+// clients can highlight the offending inputs.
+type FieldErrorer interface {
+	error
+	Fields() map[string]string
+}
+
+// ValidationError is an errors.EInvalid error listing the invalid fields of
+// a request. The fields are included in the error response details.
+type ValidationError struct {
+	FieldErrors []FieldError
+}
+
+// NewValidationError returns a ValidationError for the fields, mapped to
+// their messages, sorted by field.
+func NewValidationError(fields map[string]string) *ValidationError {
+	e := &ValidationError{FieldErrors: make([]FieldError, 0, len(fields))}
+	for field, msg := range fields {
+		e.FieldErrors = append(e.FieldErrors, FieldError{Field: field, Message: msg})
+	}
+	sort.Slice(e.FieldErrors, func(i, j int) bool {
+		return e.FieldErrors[i].Field < e.FieldErrors[j].Field
+	})
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.FieldErrors) == 1 {
+		return fmt.Sprintf("invalid %s: %s", e.FieldErrors[0].Field, e.FieldErrors[0].Message)
+	}
+	return fmt.Sprintf("request is invalid: %d invalid field(s)", len(e.FieldErrors))
+}
+
+// Fields implements FieldErrorer.
+func (e *ValidationError) Fields() map[string]string {
+	fields := make(map[string]string, len(e.FieldErrors))
+	for _, fe := range e.FieldErrors {
+		fields[fe.Field] = fe.Message
+	}
+	return fields
+}
+
+// Unwrap exposes the platform error, so the error maps to a 400.
+func (e *ValidationError) Unwrap() error {
+	return &errors.Error{
+		Code: errors.EInvalid,
+		Msg:  e.Error(),
+	}
+}
+
+// ErrorDetails implements ErrorDetailer.
+func (e *ValidationError) ErrorDetails() interface{} {
+	return e.FieldErrors
+}
+
+// fieldValidationError converts a FieldErrorer in err's chain without
+// details of its own into a ValidationError, so its fields are written in
+// the error response. Other errors are returned as is.
+func fieldValidationError(err error) error {
+	var fe FieldErrorer
+	if !errorsv2.As(err, &fe) || errorDetails(err) != nil {
+		return err
+	}
+	return NewValidationError(fe.Fields())
+}